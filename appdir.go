@@ -0,0 +1,235 @@
+package homedir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// appName stores the application name set via SetAppName (empty when unset)
+var appName atomic.Value
+
+func init() {
+	appName.Store("")
+}
+
+// ConfigDir returns the base directory for user-specific configuration files:
+// $XDG_CONFIG_HOME (if set to an absolute path) or else ~/.config on Unix
+// systems, ~/Library/Application Support on macOS, %AppData% on Windows and
+// $home/lib on Plan 9. Like os.UserConfigDir, the directory is not created.
+func ConfigDir() (string, error) {
+	return configDir(runtime.GOOS)
+}
+
+func configDir(goos string) (string, error) {
+	return baseDir(goos, baseDirLayout{
+		windowsVar: "AppData",
+		xdgVar:     "XDG_CONFIG_HOME",
+		darwin:     []string{"Library", "Application Support"},
+		plan9:      []string{"lib"},
+		unix:       []string{".config"},
+	})
+}
+
+// baseDirLayout describes where a base directory is located on each platform.
+type baseDirLayout struct {
+	windowsVar string   // the environment variable holding the directory on Windows
+	xdgVar     string   // the XDG base directory variable honored on Unix systems
+	darwin     []string // the path under the home directory on macOS and iOS
+	plan9      []string // the path under the home directory on Plan 9
+	unix       []string // the path under the home directory on other Unix systems
+}
+
+func baseDir(goos string, layout baseDirLayout) (string, error) {
+	if goos == "windows" {
+		if dir := os.Getenv(layout.windowsVar); dir != "" {
+			return dir, nil
+		}
+		return "", fmt.Errorf("%s is not set", layout.windowsVar)
+	}
+
+	if goos != "darwin" && goos != "ios" && goos != "plan9" {
+		// per the XDG base directory spec, relative paths are ignored
+		if dir := os.Getenv(layout.xdgVar); dir != "" && filepath.IsAbs(dir) {
+			return dir, nil
+		}
+	}
+
+	home, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	sub := layout.unix
+	switch goos {
+	case "darwin", "ios":
+		sub = layout.darwin
+	case "plan9":
+		sub = layout.plan9
+	}
+	return filepath.Join(append([]string{home}, sub...)...), nil
+}
+
+// DataDir returns the base directory for user-specific application data:
+// $XDG_DATA_HOME (if set to an absolute path) or else ~/.local/share on Unix
+// systems, ~/Library/Application Support on macOS, %LocalAppData% on Windows
+// and $home/lib on Plan 9. Like os.UserConfigDir, the directory is not created.
+func DataDir() (string, error) {
+	return dataDir(runtime.GOOS)
+}
+
+func dataDir(goos string) (string, error) {
+	return baseDir(goos, baseDirLayout{
+		windowsVar: "LocalAppData",
+		xdgVar:     "XDG_DATA_HOME",
+		darwin:     []string{"Library", "Application Support"},
+		plan9:      []string{"lib"},
+		unix:       []string{".local", "share"},
+	})
+}
+
+// CacheDir returns the base directory for user-specific cached data:
+// $XDG_CACHE_HOME (if set to an absolute path) or else ~/.cache on Unix
+// systems, ~/Library/Caches on macOS, %LocalAppData% on Windows and
+// $home/lib/cache on Plan 9. Like os.UserCacheDir, the directory is not created.
+func CacheDir() (string, error) {
+	return cacheDir(runtime.GOOS)
+}
+
+func cacheDir(goos string) (string, error) {
+	return baseDir(goos, baseDirLayout{
+		windowsVar: "LocalAppData",
+		xdgVar:     "XDG_CACHE_HOME",
+		darwin:     []string{"Library", "Caches"},
+		plan9:      []string{"lib", "cache"},
+		unix:       []string{".cache"},
+	})
+}
+
+// LockFilePath returns the path of a lock file with the given name, for tools
+// that coordinate (e.g. run as a single instance) via a lock file. The lock
+// file is placed in $XDG_RUNTIME_DIR (if set to an absolute path) on Unix
+// systems, or else in the cache directory (see CacheDir). The name must be a
+// single path element, so it must not be empty, "." or "..", nor contain path
+// separators. Neither the file nor its directory is created.
+func LockFilePath(name string) (string, error) {
+	return lockFilePath(runtime.GOOS, name)
+}
+
+func lockFilePath(goos, name string) (string, error) {
+	if err := checkPathElement("name", name); err != nil {
+		return "", err
+	}
+
+	if goos != "windows" && goos != "darwin" && goos != "ios" && goos != "plan9" {
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && filepath.IsAbs(dir) {
+			return filepath.Join(dir, name), nil
+		}
+	}
+
+	dir, err := cacheDir(goos)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// AppDataFile returns the path of the named data file of an application:
+// <DataDir>/<app>/<name>. Both app and name must be single path elements, so
+// they must not be empty, "." or "..", nor contain path separators.
+func AppDataFile(app, name string) (string, error) {
+	return appDataFile(runtime.GOOS, app, name)
+}
+
+func appDataFile(goos, app, name string) (string, error) {
+	if err := checkPathElement("app", app); err != nil {
+		return "", err
+	}
+	if err := checkPathElement("name", name); err != nil {
+		return "", err
+	}
+
+	dir, err := dataDir(goos)
+	if err != nil {
+		return "", err
+	}
+	return joinUnder(dir, filepath.Join(app, name))
+}
+
+// AppConfigDir returns the configuration directory of an application:
+// <ConfigDir>/<app>. The app name must be a single path element, so it must
+// not be empty, "." or "..", nor contain path separators. The directory is
+// not created.
+func AppConfigDir(app string) (string, error) {
+	return appDir(app, configDir)
+}
+
+// AppCacheDir returns the cache directory of an application: <CacheDir>/<app>
+// (see AppConfigDir for the requirements on app).
+func AppCacheDir(app string) (string, error) {
+	return appDir(app, cacheDir)
+}
+
+// AppDataDir returns the data directory of an application: <DataDir>/<app>
+// (see AppConfigDir for the requirements on app).
+func AppDataDir(app string) (string, error) {
+	return appDir(app, dataDir)
+}
+
+func appDir(app string, base func(goos string) (string, error)) (string, error) {
+	if err := checkPathElement("app", app); err != nil {
+		return "", err
+	}
+
+	dir, err := base(runtime.GOOS)
+	if err != nil {
+		return "", err
+	}
+	return joinUnder(dir, app)
+}
+
+// SetAppName sets the application name used by AppConfig, AppCache and
+// AppData, so that applications settling on a single name do not have to
+// pass it on every call. The name is validated like the app argument of
+// AppConfigDir, so an empty name is rejected.
+func SetAppName(name string) error {
+	if err := checkPathElement("app name", name); err != nil {
+		return err
+	}
+	appName.Store(name)
+	return nil
+}
+
+// AppConfig is like AppConfigDir, using the name set via SetAppName.
+func AppConfig() (string, error) {
+	return defaultAppDir(configDir)
+}
+
+// AppCache is like AppCacheDir, using the name set via SetAppName.
+func AppCache() (string, error) {
+	return defaultAppDir(cacheDir)
+}
+
+// AppData is like AppDataDir, using the name set via SetAppName.
+func AppData() (string, error) {
+	return defaultAppDir(dataDir)
+}
+
+func defaultAppDir(base func(goos string) (string, error)) (string, error) {
+	app := appName.Load().(string)
+	if app == "" {
+		return "", errors.New("no app name set (see SetAppName)")
+	}
+	return appDir(app, base)
+}
+
+// checkPathElement returns an error if elem is not a single, non-special path element.
+func checkPathElement(kind, elem string) error {
+	if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, `/\`) {
+		return fmt.Errorf("invalid %s %q: must be a single path element", kind, elem)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package homedir
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAppDataFile(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+	patchEnv(t, "LocalAppData", `C:\Users\me\AppData\Local`)
+
+	tests := []struct {
+		name        string
+		goos        string
+		xdgDataHome string
+		app         string
+		file        string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "linux",
+			goos:     "linux",
+			app:      "app",
+			file:     "app.db",
+			expected: filepath.Join("/home/me", ".local", "share", "app", "app.db"),
+		},
+		{
+			name:        "linux with XDG_DATA_HOME",
+			goos:        "linux",
+			xdgDataHome: "/data",
+			app:         "app",
+			file:        "app.db",
+			expected:    filepath.Join("/data", "app", "app.db"),
+		},
+		{
+			name:        "relative XDG_DATA_HOME is ignored",
+			goos:        "freebsd",
+			xdgDataHome: "data",
+			app:         "app",
+			file:        "app.db",
+			expected:    filepath.Join("/home/me", ".local", "share", "app", "app.db"),
+		},
+		{
+			name:        "darwin",
+			goos:        "darwin",
+			xdgDataHome: "/data",
+			app:         "app",
+			file:        "app.db",
+			expected:    filepath.Join("/home/me", "Library", "Application Support", "app", "app.db"),
+		},
+		{
+			name:     "plan9",
+			goos:     "plan9",
+			app:      "app",
+			file:     "app.db",
+			expected: filepath.Join("/home/me", "lib", "app", "app.db"),
+		},
+		{
+			name:     "windows",
+			goos:     "windows",
+			app:      "app",
+			file:     "app.db",
+			expected: filepath.Join(`C:\Users\me\AppData\Local`, "app", "app.db"),
+		},
+		{
+			name:        "parent app",
+			goos:        "linux",
+			app:         "..",
+			file:        "app.db",
+			expectError: true,
+		},
+		{
+			name:        "name with separator",
+			goos:        "linux",
+			app:         "app",
+			file:        "../../app.db",
+			expectError: true,
+		},
+		{
+			name:        "name with backslash",
+			goos:        "windows",
+			app:         "app",
+			file:        `..\app.db`,
+			expectError: true,
+		},
+		{
+			name:        "empty name",
+			goos:        "linux",
+			app:         "app",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patchEnv(t, "XDG_DATA_HOME", tc.xdgDataHome)
+
+			actual, err := appDataFile(tc.goos, tc.app, tc.file)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("appDataFile(%q, %q) error: got %v, want error: %v", tc.app, tc.file, err, tc.expectError)
+			}
+			if actual != tc.expected {
+				t.Errorf("appDataFile(%q, %q) = %q, want %q", tc.app, tc.file, actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLockFilePath(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+	patchEnv(t, "LocalAppData", `C:\Users\me\AppData\Local`)
+	patchEnv(t, "XDG_CACHE_HOME", "")
+
+	tests := []struct {
+		name          string
+		goos          string
+		xdgRuntimeDir string
+		lock          string
+		expected      string
+		expectError   bool
+	}{
+		{
+			name:          "linux runtime dir",
+			goos:          "linux",
+			xdgRuntimeDir: "/run/user/1000",
+			lock:          "app.lock",
+			expected:      filepath.Join("/run/user/1000", "app.lock"),
+		},
+		{
+			name:     "linux without runtime dir",
+			goos:     "linux",
+			lock:     "app.lock",
+			expected: filepath.Join("/home/me", ".cache", "app.lock"),
+		},
+		{
+			name:          "relative runtime dir is ignored",
+			goos:          "linux",
+			xdgRuntimeDir: "run",
+			lock:          "app.lock",
+			expected:      filepath.Join("/home/me", ".cache", "app.lock"),
+		},
+		{
+			name:          "darwin",
+			goos:          "darwin",
+			xdgRuntimeDir: "/run/user/1000",
+			lock:          "app.lock",
+			expected:      filepath.Join("/home/me", "Library", "Caches", "app.lock"),
+		},
+		{
+			name:     "windows",
+			goos:     "windows",
+			lock:     "app.lock",
+			expected: filepath.Join(`C:\Users\me\AppData\Local`, "app.lock"),
+		},
+		{
+			name:        "name with separator",
+			goos:        "linux",
+			lock:        "../app.lock",
+			expectError: true,
+		},
+		{
+			name:        "name with backslash",
+			goos:        "windows",
+			lock:        `locks\app.lock`,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patchEnv(t, "XDG_RUNTIME_DIR", tc.xdgRuntimeDir)
+
+			actual, err := lockFilePath(tc.goos, tc.lock)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("lockFilePath(%q) error: got %v, want error: %v", tc.lock, err, tc.expectError)
+			}
+			if actual != tc.expected {
+				t.Errorf("lockFilePath(%q) = %q, want %q", tc.lock, actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestConfigDir(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+	patchEnv(t, "AppData", `C:\Users\me\AppData\Roaming`)
+
+	tests := []struct {
+		name          string
+		goos          string
+		xdgConfigHome string
+		expected      string
+	}{
+		{
+			name:     "linux",
+			goos:     "linux",
+			expected: filepath.Join("/home/me", ".config"),
+		},
+		{
+			name:          "linux with XDG_CONFIG_HOME",
+			goos:          "linux",
+			xdgConfigHome: "/config",
+			expected:      "/config",
+		},
+		{
+			name:          "relative XDG_CONFIG_HOME is ignored",
+			goos:          "freebsd",
+			xdgConfigHome: "config",
+			expected:      filepath.Join("/home/me", ".config"),
+		},
+		{
+			name:          "darwin",
+			goos:          "darwin",
+			xdgConfigHome: "/config",
+			expected:      filepath.Join("/home/me", "Library", "Application Support"),
+		},
+		{
+			name:     "plan9",
+			goos:     "plan9",
+			expected: filepath.Join("/home/me", "lib"),
+		},
+		{
+			name:     "windows",
+			goos:     "windows",
+			expected: `C:\Users\me\AppData\Roaming`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patchEnv(t, "XDG_CONFIG_HOME", tc.xdgConfigHome)
+
+			actual, err := configDir(tc.goos)
+			if err != nil {
+				t.Fatalf("configDir(%q) failed: %s", tc.goos, err)
+			}
+			if actual != tc.expected {
+				t.Errorf("configDir(%q) = %q, want %q", tc.goos, actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSetAppName(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+
+	if _, err := AppConfig(); err == nil {
+		t.Error("expected an error without an app name")
+	}
+
+	for _, name := range []string{"", ".", "..", "a/b", `a\b`} {
+		if err := SetAppName(name); err == nil {
+			t.Errorf("SetAppName(%q) succeeded, want error", name)
+		}
+	}
+
+	if err := SetAppName("app"); err != nil {
+		t.Fatalf("SetAppName() failed: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		implicit func() (string, error)
+		explicit func(app string) (string, error)
+	}{
+		{"config", AppConfig, AppConfigDir},
+		{"cache", AppCache, AppCacheDir},
+		{"data", AppData, AppDataDir},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			expected, err := tc.explicit("app")
+			if err != nil {
+				t.Fatalf("explicit %s dir failed: %s", tc.name, err)
+			}
+			actual, err := tc.implicit()
+			if err != nil {
+				t.Fatalf("implicit %s dir failed: %s", tc.name, err)
+			}
+			if actual != expected {
+				t.Errorf("expected %q, got %q", expected, actual)
+			}
+			if filepath.Base(actual) != "app" {
+				t.Errorf("expected %q to end with the app name", actual)
+			}
+		})
+	}
+
+	if _, err := AppConfigDir(".."); err == nil {
+		t.Error("expected an error for an invalid app name")
+	}
+}
@@ -0,0 +1,36 @@
+package homedir
+
+import "fmt"
+
+// HomeDiskUsage reports the total size of the filesystem containing the home
+// directory (see Dir) and the space on it that is available to the executing
+// user, in bytes. This is supported on Linux, macOS and Windows.
+func HomeDiskUsage() (total, free uint64, err error) {
+	dir, err := Dir()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	total, free, err = diskUsage(dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to determine disk usage of %q: %w", dir, err)
+	}
+	return total, free, nil
+}
+
+// HomeIsNetworkFS reports whether the home directory (see Dir) is on a network
+// filesystem such as NFS or SMB, e.g. so that tools can avoid relying on lock
+// files there. This is supported on Linux (by filesystem type), macOS (by
+// filesystem name) and Windows (by drive type).
+func HomeIsNetworkFS() (bool, error) {
+	dir, err := Dir()
+	if err != nil {
+		return false, err
+	}
+
+	network, err := isNetworkFS(dir)
+	if err != nil {
+		return false, fmt.Errorf("unable to determine filesystem type of %q: %w", dir, err)
+	}
+	return network, nil
+}
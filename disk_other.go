@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package homedir
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func diskUsage(string) (total, free uint64, err error) {
+	return 0, 0, fmt.Errorf("disk usage is not supported on %s", runtime.GOOS)
+}
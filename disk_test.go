@@ -0,0 +1,62 @@
+package homedir
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestHomeDiskUsage(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "windows":
+	default:
+		if _, _, err := HomeDiskUsage(); err == nil {
+			t.Errorf("expected an unsupported error on %s", runtime.GOOS)
+		}
+		return
+	}
+
+	restoreCache(t)
+	SetHomeDir(t.TempDir())
+
+	total, free, err := HomeDiskUsage()
+	if err != nil {
+		t.Fatalf("HomeDiskUsage() failed: %s", err)
+	}
+	if total == 0 {
+		t.Error("expected a non-zero total")
+	}
+	if free > total {
+		t.Errorf("expected free space (%d) not to exceed the total (%d)", free, total)
+	}
+
+	SetHomeDir("/does/not/exist")
+	if _, _, err := HomeDiskUsage(); err == nil {
+		t.Error("expected error for a missing home directory")
+	}
+}
+
+func TestHomeIsNetworkFS(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "windows":
+	default:
+		if _, err := HomeIsNetworkFS(); err == nil {
+			t.Errorf("expected an unsupported error on %s", runtime.GOOS)
+		}
+		return
+	}
+
+	restoreCache(t)
+	SetHomeDir(t.TempDir())
+
+	// the temp dir is generally on a local filesystem, but not asserted to be
+	if _, err := HomeIsNetworkFS(); err != nil {
+		t.Fatalf("HomeIsNetworkFS() failed: %s", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		SetHomeDir("/does/not/exist")
+		if _, err := HomeIsNetworkFS(); err == nil {
+			t.Error("expected error for a missing home directory")
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/anchore/go-homedir
 
-go 1.19
+go 1.20
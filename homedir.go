@@ -1,15 +1,22 @@
 package homedir
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 const defaultCacheEnabled = true
@@ -18,166 +25,2267 @@ const defaultCacheEnabled = true
 // Note that by default, caching is enabled (true value).
 var cacheEnabled atomic.Bool
 
-// homedirCache stores the cached home directory path
+// DisableCache disables caching when set to true, regardless of
+// SetCacheEnable. It exists for compatibility with mitchellh/go-homedir, so
+// that code written against it keeps working after switching the import path.
+// Unlike SetCacheEnable, it is not safe to change concurrently with other
+// calls into this package, so it should only be set during initialization
+// (or in tests); prefer SetCacheEnable in new code.
+var DisableCache bool
+
+// caching reports whether the caches should be used.
+func caching() bool {
+	return cacheEnabled.Load() && !DisableCache
+}
+
+// homedirCache stores the cached home directory (as a cacheEntry)
 var homedirCache atomic.Value
 
-func init() {
-	homedirCache.Store("")
-	cacheEnabled.Store(defaultCacheEnabled)
+// cacheEntry is a cached home directory along with the fingerprint of the environment it was detected in.
+type cacheEntry struct {
+	dir         string
+	fingerprint string
+	at          time.Time
+}
+
+// physicalCache stores the cached result of DirPhysical (as a physicalCacheEntry)
+var physicalCache atomic.Value
+
+// physicalCacheEntry is a cached physical home directory, keyed by the logical one it was resolved from.
+type physicalCacheEntry struct {
+	logical  string
+	physical string
+}
+
+// cacheHits and cacheMisses count the calls to Dir answered from the cache and by detection (see CacheStats).
+var cacheHits, cacheMisses atomic.Uint64
+
+// expandedTilde, expandedUser and expandedPassthrough count the successful Expand calls by outcome (see ExpandCounters).
+var expandedTilde, expandedUser, expandedPassthrough atomic.Uint64
+
+// cacheRevalidate controls whether the cached home directory is re-detected when the environment changes.
+var cacheRevalidate atomic.Bool
+
+// cacheErrors controls whether detection errors are cached as well (disabled by default).
+var cacheErrors atomic.Bool
+
+// homedirErrCache stores the cached detection error (only used when cacheErrors is enabled)
+var homedirErrCache atomic.Value
+
+// errCacheEntry wraps a cached error so that atomic.Value always stores the same concrete type, along with the
+// fingerprint of the environment it occurred in.
+type errCacheEntry struct {
+	err         error
+	fingerprint string
+}
+
+// detect runs home directory detection (swapped out in tests).
+var detect = detectHomeDir
+
+// homeValidator stores the validator set via SetHomeValidator
+var homeValidator atomic.Value
+
+// validatorEntry wraps a validator so that atomic.Value always stores the same concrete type.
+type validatorEntry struct {
+	validate func(path string) error
+}
+
+// homedirOverride stores a home directory path set via SetHomeDir (empty when unset)
+var homedirOverride atomic.Value
+
+// primaryEnvVar stores the name of the environment variable set via SetPrimaryEnvVar (empty when unset)
+var primaryEnvVar atomic.Value
+
+// dirStack stores the directory stack set via SetDirStack (nil when unset)
+var dirStack atomic.Value
+
+// statFS stores the file system set via SetStatFS (as a statFSEntry)
+var statFS atomic.Value
+
+// statFSEntry wraps a file system so that atomic.Value always stores the same concrete type.
+type statFSEntry struct {
+	fsys fs.StatFS
+}
+
+// frozenHome stores the home directory frozen via Freeze (empty until frozen)
+var frozenHome atomic.Value
+
+// logger stores the logger set via SetLogger
+var logger atomic.Value
+
+// loggerEntry wraps a Logger so that atomic.Value always stores the same concrete type.
+type loggerEntry struct {
+	logger Logger
+}
+
+// maxPathLength stores the maximum length of an expanded path (0 for unlimited)
+var maxPathLength atomic.Int64
+
+// expandAfterEquals controls whether a `~/` following the first `=` is expanded as well (disabled by default).
+var expandAfterEquals atomic.Bool
+
+// expandUserLookup controls whether `~user` paths are expanded by looking up the named user (disabled by default).
+var expandUserLookup atomic.Bool
+
+// normalizeDriveRoot controls whether a drive-only home directory (e.g. `C:`) is expanded against the drive root on Windows.
+var normalizeDriveRoot atomic.Bool
+
+// forceAbsoluteHome controls whether a relative home directory is made absolute when expanding (rejected by default).
+var forceAbsoluteHome atomic.Bool
+
+// expandCache stores the most recent Expand result (a single entry, to keep memory bounded)
+var expandCache atomic.Value
+
+// expandCacheEntry is a cached Expand result, keyed by the input path and the home directory it was expanded against.
+type expandCacheEntry struct {
+	input  string
+	home   string
+	output string
+}
+
+// expandIntern caches additional Expand results, keyed by the home directory and the input path (disabled unless sized via SetExpandCacheSize).
+var expandIntern = newLRUCache()
+
+// expandPostProcessor stores the function set via SetExpandPostProcessor (as a postProcessorEntry)
+var expandPostProcessor atomic.Value
+
+// postProcessorEntry wraps a post-processor so that atomic.Value always stores the same concrete type.
+type postProcessorEntry struct {
+	process func(path string) string
+}
+
+// expandEvictFunc stores the callback set via SetExpandCacheEvictFunc (as an evictFuncEntry)
+var expandEvictFunc atomic.Value
+
+// evictFuncEntry wraps an eviction callback so that atomic.Value always stores the same concrete type.
+type evictFuncEntry struct {
+	fn func(input, expanded string)
+}
+
+func init() {
+	homedirCache.Store(cacheEntry{})
+	homedirErrCache.Store(errCacheEntry{})
+	physicalCache.Store(physicalCacheEntry{})
+	homedirOverride.Store("")
+	frozenHome.Store("")
+	primaryEnvVar.Store("")
+	dirStack.Store([]string(nil))
+	statFS.Store(statFSEntry{})
+	hermeticFallback.Store(hermeticEntry{})
+	homeValidator.Store(validatorEntry{})
+	logger.Store(loggerEntry{})
+	expandCache.Store(expandCacheEntry{})
+	expandEvictFunc.Store(evictFuncEntry{})
+	expandPostProcessor.Store(postProcessorEntry{})
+	expandIntern.onEvict = expandEvicted
+	cacheEnabled.Store(defaultCacheEnabled)
+}
+
+// SetCacheEnable enables or disables caching of the home directory
+// (and of the most recent Expand result). By default, caching is enabled.
+func SetCacheEnable(enable bool) {
+	cacheEnabled.Store(enable)
+	if !enable {
+		physicalCache.Store(physicalCacheEntry{})
+		expandCache.Store(expandCacheEntry{})
+		expandIntern.clear()
+		userCache.clear()
+	}
+}
+
+// SetExpandCacheSize sets the number of Expand results that are cached in
+// addition to the most recent one, so that repeatedly expanded paths return
+// the same shared string without being joined again. The least recently used
+// results are evicted once the limit is reached. A size of 0 (the default)
+// disables this cache. Results are cached per home directory, and the cache is
+// cleared by Reset. Like all caches, it is only used when caching is enabled
+// (see SetCacheEnable).
+func SetExpandCacheSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	expandIntern.resize(size)
+	if size == 0 {
+		expandIntern.clear()
+	}
+}
+
+// interning reports whether the Expand cache sized via SetExpandCacheSize is
+// used. Unlike the per-user cache, which a size of 0 leaves unbounded, the
+// Expand cache is disabled by a size of 0, as the number of distinct paths
+// expanded by a program is not limited like the number of users.
+func interning() bool {
+	return caching() && expandIntern.capacity() != lruUnbounded
+}
+
+// SetExpandPostProcessor sets a function that transforms every result of
+// Expand (and the functions built on it) before it is returned, e.g. to
+// lowercase paths on a case-insensitive filesystem or to prefix a sandbox
+// root. It runs last, after the path has been expanded and cleaned, and
+// before the length limit is checked (see SetMaxPathLength). It is applied to
+// paths without a `~` prefix as well, which are otherwise returned unchanged.
+// Cached results are stored unprocessed, so changing the function takes
+// effect immediately. A nil function (the default) disables post-processing.
+func SetExpandPostProcessor(process func(path string) string) {
+	expandPostProcessor.Store(postProcessorEntry{process: process})
+}
+
+// SetExpandCacheEvictFunc sets a function that is called whenever a result is
+// evicted from the Expand cache (see SetExpandCacheSize) to make room for
+// another one, with the input path and its expanded form. Frequent evictions
+// indicate that the cache is too small for the working set. Clearing the
+// cache (e.g. via Reset) does not count as eviction. The function is called
+// without holding any lock, but possibly from several goroutines at once. A
+// nil function (the default) disables the callback.
+func SetExpandCacheEvictFunc(fn func(input, expanded string)) {
+	expandEvictFunc.Store(evictFuncEntry{fn: fn})
+}
+
+func expandEvicted(entry lruEntry) {
+	fn := expandEvictFunc.Load().(evictFuncEntry).fn
+	if fn == nil {
+		return
+	}
+	// keyed by the home directory and the input path (see expand)
+	_, input, _ := strings.Cut(entry.key, "\x00")
+	fn(input, entry.value)
+}
+
+// CacheEnabled reports whether caching is enabled (see SetCacheEnable and
+// DisableCache).
+func CacheEnabled() bool {
+	return caching()
+}
+
+// SetCacheRevalidate controls whether the cached home directory is
+// revalidated against the environment on each call to Dir. When enabled, the
+// values of the consulted environment variables (see ConsultedEnvVars) are
+// recorded alongside the cached home directory, and the home directory is
+// re-detected whenever any of them changed. This keeps the cache correct under
+// heavy environment mutation (e.g. in test suites) while still avoiding
+// detection when nothing changed. By default, this is disabled.
+func SetCacheRevalidate(enable bool) {
+	cacheRevalidate.Store(enable)
+}
+
+// SetCacheErrors controls whether a detection error is cached, so that subsequent
+// calls to Dir return it immediately instead of re-running every detection method.
+// The cached error is cleared by Reset. This only applies while caching is enabled.
+// By default, errors are not cached and detection is retried on each call.
+func SetCacheErrors(enable bool) {
+	cacheErrors.Store(enable)
+	if !enable {
+		homedirErrCache.Store(errCacheEntry{})
+	}
+}
+
+// Logger receives warnings from this package (e.g. a *log.Logger).
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// SetLogger sets the logger that receives warnings from this package. A nil
+// logger (the default) discards them.
+func SetLogger(l Logger) {
+	logger.Store(loggerEntry{logger: l})
+}
+
+func warnf(format string, v ...any) {
+	if l := logger.Load().(loggerEntry).logger; l != nil {
+		l.Printf(format, v...)
+	}
+}
+
+// SetMaxPathLength makes Expand (and its variants) return an error when an
+// expanded path is longer than n bytes, surfacing paths that are too long for
+// the target platform or filesystem at expansion time rather than at a later
+// os.Open. A value of 0 (the default) means unlimited.
+func SetMaxPathLength(n int) {
+	if n < 0 {
+		n = 0
+	}
+	maxPathLength.Store(int64(n))
+}
+
+// SetForceAbsoluteHome controls how Expand (and its variants) handles a
+// relative home directory, e.g. from a misconfigured `HOME=relative/path`.
+// By default, expanding a tilde path against a relative home directory is an
+// error, so that tilde paths never expand to relative paths. When enabled,
+// the home directory is made absolute (see filepath.Abs) instead. This applies
+// to all functions expanding tilde paths (including ExpandPlan, ExpandAsHome
+// and ExpandFunc), but not to Dir: with a relative home, Expand("~") then
+// differs from what Dir returns.
+func SetForceAbsoluteHome(force bool) {
+	forceAbsoluteHome.Store(force)
+}
+
+// SetWindowsNormalizeDriveRoot controls how Expand handles a home directory
+// consisting of just a drive letter (e.g. `C:`, as may result from unusual
+// HOMEDRIVE or USERPROFILE settings) on Windows. Joining such a home with a
+// path yields a drive-relative path (`C:x`), so by default Expand returns an
+// error instead. When enabled, the home is treated as the root of the drive
+// (`C:\`), so `~/x` expands to `C:\x`. Dir returns the home as detected
+// either way.
+func SetWindowsNormalizeDriveRoot(enable bool) {
+	normalizeDriveRoot.Store(enable)
+}
+
+// checkDriveRoot handles a drive-only home directory on Windows (see SetWindowsNormalizeDriveRoot).
+func checkDriveRoot(goos, home string) (string, error) {
+	if goos != "windows" || !isDriveOnly(home) {
+		return home, nil
+	}
+	if !normalizeDriveRoot.Load() {
+		return "", fmt.Errorf("home directory %q is drive-relative (see SetWindowsNormalizeDriveRoot)", home)
+	}
+	return home + `\`, nil
+}
+
+// isDriveOnly reports whether path is a drive letter followed by a colon, without any path.
+func isDriveOnly(path string) bool {
+	if len(path) != 2 || path[1] != ':' {
+		return false
+	}
+	c := path[0] | 0x20 // lowercase
+	return 'a' <= c && c <= 'z'
+}
+
+// SetExpandAfterEquals controls whether Expand (and its variants) also expands
+// a `~/` that immediately follows the first `=` of a path, to support
+// `KEY=~/path` assignments as used by some templating tools. Only that case is
+// supported: a `~` anywhere else is left as-is. By default, this is disabled.
+func SetExpandAfterEquals(enable bool) {
+	expandAfterEquals.Store(enable)
+}
+
+// SetExpandUserLookup controls whether Expand (and its variants) expands
+// `~user` paths for arbitrary users by looking up their home directory (see
+// DirFor). When disabled, only the homes registered via RegisterHome or
+// SetUserHomes and the directory stack entries (see SetDirStack) are
+// expanded, and any other `~user` path is handled as an unknown user (see
+// SetUnknownUserPolicy), failing with ErrUserLookupDisabled by default. By
+// default, this is disabled.
+func SetExpandUserLookup(enable bool) {
+	expandUserLookup.Store(enable)
+}
+
+// SetHomeValidator sets a function that is called with each candidate home
+// directory found during detection. If it returns an error, the candidate is
+// rejected and the next detection method is tried. This allows plugging in
+// checks such as "the directory must exist". A nil validator (the default)
+// accepts any candidate. The validator is not applied to SetHomeDir overrides.
+// Setting a validator clears the cache (see Reset), so it applies immediately.
+func SetHomeValidator(validate func(path string) error) {
+	homeValidator.Store(validatorEntry{validate: validate})
+	Reset()
+}
+
+// SetHomeDir forces Dir (and therefore Expand) to always return the given path,
+// bypassing the cache and all detection methods until ClearHomeDir is called.
+// Unlike a cached value, the override is not cleared by Reset. Passing an empty
+// path is equivalent to calling ClearHomeDir.
+func SetHomeDir(path string) {
+	homedirOverride.Store(path)
+}
+
+// ClearHomeDir removes any override set via SetHomeDir.
+func ClearHomeDir() {
+	homedirOverride.Store("")
+}
+
+// ParseHomeFlag scans command-line arguments (excluding the program name) for
+// a home directory override and applies it via SetHomeDir, so that tools can
+// support a standard `--home` flag without wiring it up themselves. The
+// supported forms are `--home=VALUE` and `--home VALUE`; if the flag is given
+// more than once, the last one wins. Scanning stops at a `--` argument, after
+// which all arguments are passed on as-is. The remaining arguments are
+// returned with the flag removed, and ok reports whether the flag was found.
+// A flag without a value is an error, in which case SetHomeDir is not called.
+func ParseHomeFlag(args []string) (remaining []string, ok bool, err error) {
+	var home string
+	remaining = make([]string, 0, len(args))
+scan:
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			remaining = append(remaining, args[i:]...)
+			break scan
+		case arg == "--home":
+			if i+1 >= len(args) {
+				return nil, false, errors.New("flag --home requires a value")
+			}
+			i++
+			home = args[i]
+		case strings.HasPrefix(arg, "--home="):
+			home = strings.TrimPrefix(arg, "--home=")
+		default:
+			remaining = append(remaining, arg)
+			continue
+		}
+		if home == "" {
+			return nil, false, errors.New("flag --home requires a non-empty value")
+		}
+		ok = true
+	}
+
+	if ok {
+		SetHomeDir(home)
+	}
+	return remaining, ok, nil
+}
+
+// Freeze resolves the home directory (see Dir) and freezes it: from then on,
+// Dir and Expand always use the frozen value, ignoring the environment,
+// Reset, Restore and all setters (including SetHomeDir). This is meant for
+// security-sensitive programs that want to resolve the home directory once at
+// startup, so that later changes to the environment cannot redirect file
+// access. Freezing is irreversible for the lifetime of the process; calling
+// Freeze again returns the frozen value.
+func Freeze() (string, error) {
+	if frozen := frozenHome.Load().(string); frozen != "" {
+		return frozen, nil
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	frozenHome.CompareAndSwap("", dir)
+	return frozenHome.Load().(string), nil
+}
+
+// Dir returns the home directory for the executing user.
+//
+// This uses an OS-specific method for discovering the home directory.
+// An error is returned if a home directory cannot be detected (see
+// DetectionError).
+//
+// The home directory is resolved in the following order of precedence:
+// a path frozen via Freeze, a path set via SetHomeDir, the cached value (when
+// caching is enabled), and finally OS-specific detection.
+func Dir() (string, error) {
+	if frozen := frozenHome.Load().(string); frozen != "" {
+		return frozen, nil
+	}
+	if override := homedirOverride.Load().(string); override != "" {
+		return override, nil
+	}
+
+	var fingerprint string
+	if cacheRevalidate.Load() {
+		fingerprint = envFingerprint()
+	}
+
+	if caching() {
+		cached := homedirCache.Load().(cacheEntry)
+		if cached.dir != "" && cached.fingerprint == fingerprint {
+			cacheHits.Add(1)
+			return cached.dir, nil
+		}
+		if cacheErrors.Load() {
+			if cached := homedirErrCache.Load().(errCacheEntry); cached.err != nil && cached.fingerprint == fingerprint {
+				cacheHits.Add(1)
+				return "", cached.err
+			}
+		}
+	}
+
+	cacheMisses.Add(1)
+	dir, err := detectWithHint()
+	if err != nil {
+		if caching() && cacheErrors.Load() {
+			homedirErrCache.Store(errCacheEntry{err: err, fingerprint: fingerprint})
+		}
+		return "", err
+	}
+
+	if caching() {
+		homedirCache.Store(cacheEntry{dir: dir, fingerprint: fingerprint, at: time.Now()})
+	}
+	return dir, nil
+}
+
+// DirPhysical returns the home directory like Dir, but with all symlinks
+// resolved, like the physical working directory reported by `pwd -P` (as
+// opposed to the logical one in $PWD). Dir keeps returning the logical path,
+// so callers can pick the form they need. The resolved path is cached
+// separately from (and invalidated along with) the one returned by Dir.
+func DirPhysical() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+
+	if caching() {
+		if cached := physicalCache.Load().(physicalCacheEntry); cached.logical == dir {
+			return cached.physical, nil
+		}
+	}
+
+	physical, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve home directory %q: %w", dir, err)
+	}
+
+	if caching() {
+		physicalCache.Store(physicalCacheEntry{logical: dir, physical: physical})
+	}
+	return physical, nil
+}
+
+// DirCached reports the cached home directory and how long ago it was
+// detected, without ever running detection. ok is false if nothing is cached
+// (e.g. before the first call to Dir, after Reset or with caching disabled).
+// Note that a path set via SetHomeDir or Freeze is not cached.
+func DirCached() (dir string, age time.Duration, ok bool) {
+	if !caching() {
+		return "", 0, false
+	}
+	cached := homedirCache.Load().(cacheEntry)
+	if cached.dir == "" {
+		return "", 0, false
+	}
+	return cached.dir, time.Since(cached.at), true
+}
+
+// CacheStats reports how often Dir was answered from the cache (hits) and
+// how often it had to run detection (misses), since the start of the process
+// or the last call to ResetStats. With caching disabled, every call is a
+// miss. Calls answered by SetHomeDir or Freeze are not counted.
+func CacheStats() (hits, misses uint64) {
+	return cacheHits.Load(), cacheMisses.Load()
+}
+
+// ExpandCounters reports how many paths were successfully expanded since the
+// start of the process or the last call to ResetStats, by outcome: paths
+// expanded against the current user's home (`~`, tilde), against another
+// home (`~user` and directory stack paths, user) and paths returned unchanged
+// (passthrough, including `~user` paths left unexpanded per
+// SetUnknownUserPolicy). All functions built on Expand are counted, failed
+// expansions are not.
+func ExpandCounters() (tilde, user, passthrough uint64) {
+	return expandedTilde.Load(), expandedUser.Load(), expandedPassthrough.Load()
+}
+
+// ResetStats resets the counters reported by CacheStats and ExpandCounters.
+func ResetStats() {
+	cacheHits.Store(0)
+	cacheMisses.Store(0)
+	expandedTilde.Store(0)
+	expandedUser.Store(0)
+	expandedPassthrough.Store(0)
+}
+
+// envFingerprint captures the values of all consulted environment variables.
+func envFingerprint() string {
+	var sb strings.Builder
+	for _, name := range ConsultedEnvVars() {
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(os.Getenv(name))
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// DirModTime returns the modification time of the home directory (see Dir).
+func DirModTime() (time.Time, error) {
+	dir, err := Dir()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	info, err := stat(dir)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to stat home directory: %w", err)
+	}
+	return info.ModTime(), nil
+}
+
+// HomeExists reports whether the home directory (see Dir) exists and is a
+// directory.
+func HomeExists() (bool, error) {
+	dir, err := Dir()
+	if err != nil {
+		return false, err
+	}
+
+	info, err := stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to stat home directory: %w", err)
+	}
+	return info.IsDir(), nil
+}
+
+// SetStatFS makes the existence checks of this package (DirModTime and
+// HomeExists) consult the given file system instead of the OS, e.g. a
+// fstest.MapFS in tests. Paths are mapped onto the file system by dropping
+// the volume name and the leading separator, so `/home/me` is looked up as
+// `home/me`. Passing nil (the default) uses the OS.
+func SetStatFS(fsys fs.StatFS) {
+	statFS.Store(statFSEntry{fsys: fsys})
+}
+
+// stat is like os.Stat, but consults the file system set via SetStatFS (if any).
+func stat(path string) (fs.FileInfo, error) {
+	fsys := statFS.Load().(statFSEntry).fsys
+	if fsys == nil {
+		return os.Stat(path)
+	}
+
+	name := filepath.ToSlash(filepath.Clean(path[len(filepath.VolumeName(path)):]))
+	if name = strings.TrimLeft(name, "/"); name == "" {
+		name = "."
+	}
+	return fsys.Stat(name)
+}
+
+// ChdirHome changes the working directory to the home directory (see Dir),
+// returning its path.
+func ChdirHome() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve home directory: %w", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return "", fmt.Errorf("unable to change to home directory: %w", err)
+	}
+	return dir, nil
+}
+
+// ChdirHomeSub changes the working directory to the given subdirectory of the
+// home directory, returning its path. An error is returned if sub would
+// escape the home directory (e.g. `../other`).
+func ChdirHomeSub(sub string) (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve home directory: %w", err)
+	}
+	path, err := joinUnder(dir, sub)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chdir(path); err != nil {
+		return "", fmt.Errorf("unable to change to home subdirectory: %w", err)
+	}
+	return path, nil
+}
+
+// homeContextKey is the context key for the home directory set via WithHome.
+type homeContextKey struct{}
+
+// WithHome returns a copy of ctx carrying the given home directory, which
+// DirContext and ExpandContext use instead of the package-wide one. This lets
+// request-scoped code (e.g. a server impersonating users) expand `~` against
+// a per-request home without changing any global settings. A home carried by
+// the context takes precedence over everything else, including Freeze,
+// SetHomeDir, the cache and the environment. `~user` paths are not affected.
+func WithHome(ctx context.Context, home string) context.Context {
+	return context.WithValue(ctx, homeContextKey{}, home)
+}
+
+// HomeFromContext returns the home directory carried by ctx (see WithHome).
+func HomeFromContext(ctx context.Context) (string, bool) {
+	home, ok := ctx.Value(homeContextKey{}).(string)
+	return home, ok && home != ""
+}
+
+// DirContext is like Dir, but returns early with the context's error if the
+// context is done before detection completes. Detection itself cannot be
+// interrupted: it continues in the background and, when caching is enabled,
+// still populates the cache once it completes. If the context carries a home
+// directory (see WithHome), it is returned without any detection.
+func DirContext(ctx context.Context) (string, error) {
+	if home, ok := HomeFromContext(ctx); ok {
+		return home, nil
+	}
+
+	type result struct {
+		dir string
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		dir, err := Dir()
+		done <- result{dir: dir, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.dir, r.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("home directory detection did not complete: %w", ctx.Err())
+	}
+}
+
+// ExpandContext is like Expand, but returns early with the context's error if
+// the context is done before the home directory is resolved, e.g. during a
+// slow user lookup for a `~user` path. Paths without a `~` prefix are returned
+// without any lookups. As with DirContext, an interrupted lookup continues in
+// the background. If the context carries a home directory (see WithHome), `~`
+// is expanded against it instead of the detected one, with everything else
+// (such as post-processing) applied as in Expand.
+func ExpandContext(ctx context.Context, path string) (string, error) {
+	var hooks expandHooks
+	home, hasHome := HomeFromContext(ctx)
+	if hasHome {
+		hooks.home = func() (string, error) {
+			return home, nil
+		}
+	}
+	expandPath := func() (string, error) {
+		result, err := expandRich(path, hooks)
+		if err != nil {
+			return "", err
+		}
+		return result.Path, nil
+	}
+
+	// only paths that may need a lookup are expanded in the background
+	if !IsTilde(path) {
+		if !expandAfterEquals.Load() {
+			return expandPath()
+		}
+	} else if username, _ := splitTilde(path); username == "" && hasHome {
+		return expandPath()
+	}
+
+	type result struct {
+		path string
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		expanded, err := expandPath()
+		done <- result{path: expanded, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.path, r.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("expanding %q did not complete: %w", path, ctx.Err())
+	}
+}
+
+// DirWithTimeout is like Dir, but returns an error wrapping
+// context.DeadlineExceeded if detection does not complete within the given
+// duration. See DirContext for how detection continues in the background.
+func DirWithTimeout(d time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return DirContext(ctx)
+}
+
+// Source identifies the method used to detect the home directory.
+type Source int
+
+const (
+	// SourceNone indicates that no home directory was detected.
+	SourceNone Source = iota
+	// SourceLoginHome is the login home of the current user (see SetDarwinUseLoginHome).
+	SourceLoginHome
+	// SourceStdlib is the standard library's os.UserHomeDir.
+	SourceStdlib
+	// SourceEnv is the OS-specific environment variables (see ConsultedEnvVars).
+	SourceEnv
+	// SourceDirectoryServices is the macOS directory services (via dscl).
+	SourceDirectoryServices
+	// SourceGetent is the passwd database (via getent, or the passwd file if getent is unavailable).
+	SourceGetent
+	// SourceShell is the home directory reported by the shell (via `cd && pwd`).
+	SourceShell
+	// SourceSSHUser is the home directory of the user named by SSH_USER or LOGNAME (see SetRespectSSHUser).
+	SourceSSHUser
+	// SourcePrimaryEnv is the environment variable set via SetPrimaryEnvVar.
+	SourcePrimaryEnv
+	// SourceServiceProfile is the profile of the Windows LocalSystem account (see SetWindowsServiceProfileFallback).
+	SourceServiceProfile
+	// SourceLogname is the home directory of the user named by LOGNAME or USER (see SetLognameFallback).
+	SourceLogname
+	// SourceHermetic is the fallback home for hermetic build sandboxes (see SetHermeticFallback).
+	SourceHermetic
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceNone:
+		return "none"
+	case SourceLoginHome:
+		return "login-home"
+	case SourceStdlib:
+		return "stdlib"
+	case SourceEnv:
+		return "env"
+	case SourceDirectoryServices:
+		return "directory-services"
+	case SourceGetent:
+		return "getent"
+	case SourceShell:
+		return "shell"
+	case SourceSSHUser:
+		return "ssh-user"
+	case SourcePrimaryEnv:
+		return "primary-env"
+	case SourceServiceProfile:
+		return "service-profile"
+	case SourceLogname:
+		return "logname"
+	case SourceHermetic:
+		return "hermetic"
+	}
+	return "Source(" + strconv.Itoa(int(s)) + ")"
+}
+
+// SetPrimaryEnvVar sets an environment variable that detection consults
+// before any of the platform's default methods (e.g. a home provided by a CI
+// system), so that `SetPrimaryEnvVar("MY_HOME")` makes a non-empty $MY_HOME
+// win over $HOME. An empty name (the default) disables it. Changing this
+// setting clears the cache (see Reset).
+func SetPrimaryEnvVar(name string) {
+	primaryEnvVar.Store(name)
+	Reset()
+}
+
+func primaryEnvHome() (string, error) {
+	if name := primaryEnvVar.Load().(string); name != "" {
+		return os.Getenv(name), nil
+	}
+	return "", nil
+}
+
+// windowsServiceProfile controls whether the LocalSystem profile is used as a last resort on Windows (disabled by default).
+var windowsServiceProfile atomic.Bool
+
+// isLocalSystem reports whether the process runs as the Windows LocalSystem account (swapped out in tests).
+var isLocalSystem = runningAsLocalSystem
+
+// SetWindowsServiceProfileFallback controls whether detection on Windows falls
+// back to the profile of the LocalSystem account
+// (`%SystemRoot%\System32\config\systemprofile`) when the process runs as
+// that account and the environment does not name a home directory, as is
+// common for services. By default, this is disabled. Changing this setting
+// clears the cache (see Reset).
+func SetWindowsServiceProfileFallback(enable bool) {
+	windowsServiceProfile.Store(enable)
+	Reset()
+}
+
+func serviceProfileHome() (string, error) {
+	if !windowsServiceProfile.Load() || !isLocalSystem() {
+		return "", nil
+	}
+
+	root := os.Getenv("SystemRoot")
+	if root == "" {
+		root = `C:\Windows`
+	}
+	return strings.TrimRight(root, `\`) + `\System32\config\systemprofile`, nil
+}
+
+// lognameFallback controls whether the user named by LOGNAME or USER is looked up during detection (disabled by default).
+var lognameFallback atomic.Bool
+
+// SetLognameFallback controls whether detection on systems other than Windows
+// looks up the home directory of the user named by the LOGNAME (or, if unset,
+// USER) environment variable when neither HOME nor the passwd entry of the
+// current user yield a home directory, as can happen in minimal containers
+// running with an arbitrary uid. By default, this is disabled. Changing this
+// setting clears the cache (see Reset).
+func SetLognameFallback(enable bool) {
+	lognameFallback.Store(enable)
+	Reset()
+}
+
+func lognameHome() (string, error) {
+	if !lognameFallback.Load() {
+		return "", nil
+	}
+
+	name := os.Getenv("LOGNAME")
+	if name == "" {
+		name = os.Getenv("USER")
+	}
+	if name == "" {
+		return "", nil
+	}
+
+	home, err := lookupHome(name)
+	if err != nil {
+		// not fatal, fall back to the shell
+		return "", nil
+	}
+	return home, nil
+}
+
+// strategy is a single home directory detection method. An empty result
+// means the next strategy should be tried, while an error stops detection.
+type strategy struct {
+	source Source
+	find   func() (string, error)
+}
+
+// Detect runs the home directory detection methods for the current platform
+// and reports the detected directory along with the Source that produced it.
+// Unlike Dir, this always runs detection: neither the cache nor SetHomeDir
+// are consulted, and the result is not cached.
+// If all methods fail and a hermetic fallback is set (see SetHermeticFallback),
+// the fallback is reported instead of the error.
+func Detect() (dir string, src Source, err error) {
+	return orHermetic(runStrategies(runtime.GOOS, strategies(runtime.GOOS)))
+}
+
+// orHermetic replaces a detection error with the hermetic fallback, if set.
+func orHermetic(dir string, src Source, err error) (string, Source, error) {
+	fallback, ok := hermeticHome()
+	if err == nil || !ok {
+		return dir, src, err
+	}
+	if err := fallback.create(); err != nil {
+		return "", SourceNone, err
+	}
+	return fallback.dir, SourceHermetic, nil
+}
+
+// hermeticFallback stores the fallback set via SetHermeticFallback (as a hermeticEntry)
+var hermeticFallback atomic.Value
+
+// hermeticEntry is the hermetic fallback home, and whether it is the default one that is created on use.
+type hermeticEntry struct {
+	dir     string
+	created bool
+}
+
+// SetHermeticFallback sets a home directory that detection falls back to when
+// all detection methods fail, as is common in hermetic build sandboxes (e.g.
+// Bazel) where HOME is unset and the user database is unavailable. Unlike
+// SetHomeDir, the fallback never takes precedence over a detected home
+// directory. If dir is empty, a per-user directory under os.TempDir is used,
+// which is created (if missing) when the fallback is used. As the temp dir is
+// shared, an existing directory is only used if it is not a symlink and, on
+// Unix systems, is owned by the current (effective) user with mode 0700.
+// Changing this setting clears the cache (see Reset).
+func SetHermeticFallback(dir string) {
+	entry := hermeticEntry{dir: dir}
+	if dir == "" {
+		name := "go-homedir"
+		if uid := os.Geteuid(); uid >= 0 {
+			name += "-" + strconv.Itoa(uid)
+		}
+		entry = hermeticEntry{dir: filepath.Join(os.TempDir(), name), created: true}
+	}
+	hermeticFallback.Store(entry)
+	Reset()
+}
+
+// ClearHermeticFallback removes the fallback set via SetHermeticFallback.
+func ClearHermeticFallback() {
+	hermeticFallback.Store(hermeticEntry{})
+	Reset()
+}
+
+func hermeticHome() (hermeticEntry, bool) {
+	entry := hermeticFallback.Load().(hermeticEntry)
+	return entry, entry.dir != ""
+}
+
+// create creates the default fallback directory, if this is the one.
+func (e hermeticEntry) create() error {
+	if !e.created {
+		return nil
+	}
+	if err := os.Mkdir(e.dir, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("cannot create hermetic fallback home: %w", err)
+	}
+
+	// the name is predictable, so another user may have created it first
+	info, err := os.Lstat(e.dir)
+	if err != nil {
+		return fmt.Errorf("cannot create hermetic fallback home: %w", err)
+	}
+	if !privateDir(info) {
+		return fmt.Errorf("hermetic fallback home %q is not a private directory of the current user", e.dir)
+	}
+	return nil
+}
+
+// detectHomeDir tries to detect the user's home directory using various methods
+func detectHomeDir() (string, error) {
+	dir, _, err := Detect()
+	return dir, err
+}
+
+// ignoreEnv controls whether detection skips all methods influenced by environment variables (disabled by default).
+var ignoreEnv atomic.Bool
+
+// SetIgnoreEnv controls whether detection ignores the environment entirely
+// and only consults the user database for the current (effective) user: the
+// passwd database via getent (or the passwd file) on Unix systems and the
+// directory services on macOS. The tools are run from their standard location
+// in /usr/bin, without consulting $PATH, a shell or passing on the
+// environment. This is meant for security-sensitive programs
+// such as setuid binaries, which must not trust an inherited $HOME. Methods
+// skipped include HOME and the other consulted environment variables (see
+// ConsultedEnvVars), os.UserHomeDir, the shell and the users named by
+// environment variables (see SetRespectSSHUser and SetLognameFallback). As
+// all detection methods on Windows rely on the environment, detection always
+// fails there when enabled. Overrides (see SetHomeDir) and the hermetic
+// fallback still apply. By default, this is disabled. Changing this setting
+// clears the cache (see Reset).
+func SetIgnoreEnv(enable bool) {
+	ignoreEnv.Store(enable)
+	Reset()
+}
+
+// usesEnv reports whether the detection method is influenced by environment variables.
+func usesEnv(src Source) bool {
+	switch src {
+	case SourceLoginHome, SourceDirectoryServices, SourceGetent:
+		return false
+	}
+	return true
+}
+
+// strategies returns all detection methods for the given OS, in order.
+func strategies(goos string) []strategy {
+	list := append([]strategy{
+		// honor an explicitly requested forced-command SSH user first
+		{SourceSSHUser, sshUserHome},
+		// honor an explicitly requested environment variable before the platform defaults
+		{SourcePrimaryEnv, primaryEnvHome},
+		// honor any platform-specific preference over the environment (e.g. the macOS login home)
+		{SourceLoginHome, func() (string, error) { return preferredHome(), nil }},
+		// always check with the standard lib approach first
+		{SourceStdlib, stdlibHome},
+	}, fallbackStrategies(goos)...)
+
+	if !ignoreEnv.Load() {
+		return list
+	}
+	trusted := list[:0]
+	for _, s := range list {
+		if !usesEnv(s.source) {
+			trusted = append(trusted, s)
+		}
+	}
+	return trusted
+}
+
+// fallbackStrategies returns the OS-specific detection methods used when the standard lib approach fails.
+func fallbackStrategies(goos string) []strategy {
+	if goos == "windows" {
+		return []strategy{
+			{SourceEnv, func() (string, error) { return envWindows(), nil }},
+			// services may run without any of the usual env vars set
+			{SourceServiceProfile, serviceProfileHome},
+		}
+	}
+
+	list := []strategy{{SourceEnv, func() (string, error) { return envUnix(goos), nil }}}
+
+	// if that fails, try OS specific commands
+	if goos == "darwin" {
+		list = append(list, strategy{SourceDirectoryServices, func() (string, error) { return dsclHome(), nil }})
+	} else {
+		list = append(list, strategy{SourceGetent, currentUserHome})
+	}
+
+	// then try the user named by the environment, if enabled
+	list = append(list, strategy{SourceLogname, lognameHome})
+
+	// if all else fails, try the shell
+	return append(list, strategy{SourceShell, func() (string, error) { return shellHome(), nil }})
+}
+
+func runStrategies(goos string, list []strategy) (string, Source, error) {
+	validate := homeValidator.Load().(validatorEntry).validate
+
+	var rejected error
+	attempted := make([]Source, 0, len(list))
+	for _, s := range list {
+		attempted = append(attempted, s.source)
+		dir, err := s.find()
+		if err != nil {
+			return "", SourceNone, fmt.Errorf("%w: %s: %w", ErrNoHomeDir, s.source, err)
+		}
+		if dir == "" {
+			continue
+		}
+		if validate != nil {
+			if err := validate(dir); err != nil {
+				rejected = fmt.Errorf("home directory %q from %s rejected: %w", dir, s.source, err)
+				continue
+			}
+		}
+		return dir, s.source, nil
+	}
+
+	return "", SourceNone, &DetectionError{Attempted: attempted, GOOS: goos, rejected: rejected}
+}
+
+// ErrNoHomeDir is returned (wrapped) when the home directory cannot be
+// detected, e.g. in a DetectionError when none of the detection methods found
+// a home directory. Expand wraps it when a tilde path cannot be expanded
+// because of that, as opposed to ErrUnknownUser and ErrBadTilde, which
+// indicate a problem with the path itself.
+var ErrNoHomeDir = errors.New("unable to detect home directory")
+
+// ErrBadTilde is returned (wrapped) by Expand for a malformed `~user` prefix,
+// i.e. one that cannot name a user, such as `~my user/x` or `~a:b`.
+var ErrBadTilde = errors.New("malformed tilde prefix")
+
+// ErrUserLookupDisabled is returned (wrapped) when expanding a `~user` path
+// for an unregistered user while user lookups are disabled (see
+// SetExpandUserLookup). Such errors also wrap ErrUnknownUser, so the
+// UnknownUserPolicy applies to them.
+var ErrUserLookupDisabled = errors.New("user lookup is disabled")
+
+// invalidUsernameChars are the characters that cannot be part of a username in a `~user` prefix.
+const invalidUsernameChars = " \t\n\r\x00:~"
+
+// DetectionError is returned by Dir (and Detect) when none of the detection
+// methods found a home directory. It wraps ErrNoHomeDir, as well as the
+// error returned by the validator for the last rejected candidate, if any
+// (see SetHomeValidator).
+type DetectionError struct {
+	// Attempted lists the detection methods that were tried, in order.
+	Attempted []Source
+	// GOOS is the OS the detection methods were chosen for.
+	GOOS string
+
+	rejected error
+}
+
+func (e *DetectionError) Error() string {
+	tried := make([]string, len(e.Attempted))
+	for i, src := range e.Attempted {
+		tried[i] = src.String()
+	}
+
+	msg := fmt.Sprintf("%s on %s (tried %s)", ErrNoHomeDir, e.GOOS, strings.Join(tried, ", "))
+	if e.rejected != nil {
+		msg += ": " + e.rejected.Error()
+	}
+	return msg
+}
+
+func (e *DetectionError) Unwrap() []error {
+	if e.rejected != nil {
+		return []error{ErrNoHomeDir, e.rejected}
+	}
+	return []error{ErrNoHomeDir}
+}
+
+func stdlibHome() (string, error) {
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		// not fatal, the OS-specific methods are tried next
+		return "", nil
+	}
+	return dir, nil
+}
+
+// ConsultedEnvVars returns the names of the environment variables that home
+// directory detection checks on the current platform, in order of precedence.
+func ConsultedEnvVars() []string {
+	var names []string
+	if respectSSHUser.Load() {
+		names = append(names, "SSH_USER", "LOGNAME")
+	}
+	if name := primaryEnvVar.Load().(string); name != "" {
+		names = append(names, name)
+	}
+	names = append(names, consultedEnvVars(runtime.GOOS)...)
+	if lognameFallback.Load() && runtime.GOOS != "windows" {
+		// the user named by these is looked up after the other variables are checked
+		names = append(names, "LOGNAME", "USER")
+	}
+	return names
+}
+
+func consultedEnvVars(goos string) []string {
+	switch goos {
+	case "windows":
+		// os.UserHomeDir checks USERPROFILE before dirWindows checks the remaining variables
+		return []string{"USERPROFILE", "HOME", "HOMEDRIVE", "HOMEPATH"}
+	case "plan9":
+		return []string{"home"}
+	default:
+		return []string{"HOME"}
+	}
+}
+
+// SameHome reports whether the environment-based detection for goos (see
+// ConsultedEnvVars) resolves envA and envB to the same home directory, e.g. to
+// warn when a config migration would move the home directory. Only the
+// environment variables are considered, not the other detection methods.
+// The resolved paths are compared cleaned, and case-insensitively on Windows.
+func SameHome(envA, envB map[string]string, goos string) (bool, error) {
+	homeA, err := envHome(goos, func(key string) string { return envA[key] })
+	if err != nil {
+		return false, err
+	}
+	homeB, err := envHome(goos, func(key string) string { return envB[key] })
+	if err != nil {
+		return false, err
+	}
+
+	homeA, homeB = filepath.Clean(homeA), filepath.Clean(homeB)
+	if goos == "windows" {
+		homeA, homeB = strings.ReplaceAll(homeA, "/", `\`), strings.ReplaceAll(homeB, "/", `\`)
+		return strings.EqualFold(homeA, homeB), nil
+	}
+	return homeA == homeB, nil
+}
+
+// envHome resolves the home directory from the environment variables consulted on goos.
+func envHome(goos string, getenv func(string) string) (string, error) {
+	if goos == "windows" {
+		// like os.UserHomeDir, USERPROFILE takes precedence
+		if home := getenv("USERPROFILE"); home != "" {
+			return home, nil
+		}
+		return windowsEnvHome(getenv)
+	}
+
+	homeEnv := consultedEnvVars(goos)[0]
+	if home := getenv(homeEnv); home != "" {
+		return home, nil
+	}
+	return "", fmt.Errorf("%s is not set", homeEnv)
+}
+
+// Resolve expands the path to include the home directory if the path
+// is prefixed with `~`. If it isn't prefixed with `~`, the path is
+// returned as-is. A `~user` prefix expands to the home directory
+// registered for that name (see RegisterHome) or, if enabled via
+// SetExpandUserLookup, the home directory of the named user (see DirFor).
+// As an extension, `~+N` and `~-N` expand
+// against the directory stack (see SetDirStack).
+//
+// Note that expanded tilde paths are cleaned (e.g. duplicate separators are
+// collapsed) while paths returned as-is are not. The exception is a bare `~`,
+// which expands to exactly what Dir returns. Use ExpandClean for results
+// that are cleaned consistently.
+func Resolve(path string) (string, error) {
+	result, err := ExpandRich(path)
+	if err != nil {
+		return "", err
+	}
+	return result.Path, nil
+}
+
+// Expand is the original name of Resolve and behaves identically. New code
+// should prefer Resolve; Expand remains for compatibility.
+func Expand(path string) (string, error) {
+	return Resolve(path)
+}
+
+// ExpandResult describes the outcome of expanding a path with ExpandRich.
+type ExpandResult struct {
+	// Path is the expanded path, as returned by Expand.
+	Path string
+	// Tilde reports whether the path is prefixed with `~`.
+	Tilde bool
+	// User is the username of a `~user` path (empty for `~` and non-tilde paths).
+	User string
+	// Home is the home directory the path was expanded against (empty for non-tilde paths).
+	Home string
+}
+
+// ExpandRich is like Expand, but reports the details of the expansion along
+// with the expanded path.
+func ExpandRich(path string) (ExpandResult, error) {
+	return expandRich(path, expandHooks{})
+}
+
+// expandHooks customize how expand resolves and joins the home directory.
+type expandHooks struct {
+	// join joins the home directory and the rest of the path for another
+	// system (see WithSeparator). If nil, filepath.Join is used and the
+	// results are cached.
+	join func(home, rest string) string
+	// resolve resolves the home directory of `~user` paths (see ExpandFunc).
+	// If nil, the registered homes, the directory stack and DirFor are used.
+	resolve func(user string) (string, error)
+	// home returns the home directory of `~` paths (see ExpandContext). If
+	// nil, Dir is used. If set, the results are not cached.
+	home func() (string, error)
+	// substitute rewrites the parts of the path that are not a tilde prefix
+	// (see ExpandShell). If set, the results are not cached, as they depend
+	// on more than the path and the home directory.
+	substitute func(s string) string
+	// literal makes expand return the path without expanding it, as for a
+	// path without a `~` prefix (see ExpandEscaped).
+	literal bool
+	// finish checks and rewrites the expanded path before it is
+	// post-processed (see CleanExpand).
+	finish func(result ExpandResult) (string, error)
+}
+
+// expandRich implements ExpandRich, applying the given hooks (see expand).
+func expandRich(path string, hooks expandHooks) (ExpandResult, error) {
+	result, err := expand(path, hooks)
+	if err != nil {
+		return ExpandResult{}, err
+	}
+	if hooks.finish != nil {
+		if result.Path, err = hooks.finish(result); err != nil {
+			return ExpandResult{}, err
+		}
+	}
+	if process := expandPostProcessor.Load().(postProcessorEntry).process; process != nil {
+		result.Path = process(result.Path)
+	}
+
+	if limit := maxPathLength.Load(); limit > 0 && int64(len(result.Path)) > limit {
+		return ExpandResult{}, fmt.Errorf("cannot expand %q: expanded path %q is %d bytes long, exceeding the maximum of %d", path, result.Path, len(result.Path), limit)
+	}
+
+	switch {
+	case result.Home == "":
+		expandedPassthrough.Add(1)
+	case result.User == "":
+		expandedTilde.Add(1)
+	default:
+		expandedUser.Add(1)
+	}
+	return result, nil
+}
+
+// expand expands the path, resolving and joining the home directory as
+// customized by hooks. Results are only cached without join, home and
+// substitute hooks.
+func expand(path string, hooks expandHooks) (ExpandResult, error) {
+	if hooks.literal {
+		return ExpandResult{Path: path}, nil
+	}
+
+	substitute := hooks.substitute
+	if substitute == nil {
+		substitute = func(s string) string { return s }
+	}
+
+	if !IsTilde(path) {
+		if expandAfterEquals.Load() {
+			if i := strings.IndexByte(path, '='); i >= 0 && strings.HasPrefix(path[i+1:], "~/") {
+				result, err := expand(path[i+1:], hooks)
+				if err != nil {
+					return ExpandResult{}, err
+				}
+				result.Path = substitute(path[:i+1]) + result.Path
+				return result, nil
+			}
+		}
+		return ExpandResult{Path: substitute(path)}, nil
+	}
+
+	username, dir, rest, err := planTilde(path, hooks)
+	if err != nil {
+		if username != "" {
+			return unknownUser(path, username, err)
+		}
+		return ExpandResult{}, err
+	}
+	rest = substitute(rest)
+	if hooks.join != nil {
+		return ExpandResult{Path: hooks.join(dir, rest), Tilde: true, User: username, Home: dir}, nil
+	}
+	result := ExpandResult{Tilde: true, User: username, Home: dir}
+	if hooks.substitute != nil || hooks.home != nil {
+		result.Path = dir
+		if path != "~" {
+			result.Path = filepath.Join(dir, rest)
+		}
+		return result, nil
+	}
+
+	intern := interning()
+	key := dir + "\x00" + path
+
+	if caching() {
+		cached := expandCache.Load().(expandCacheEntry)
+		if cached.input == path && cached.home == dir {
+			result.Path = cached.output
+			return result, nil
+		}
+		if intern {
+			if output, ok := expandIntern.get(key); ok {
+				result.Path = output
+				return result, nil
+			}
+		}
+	}
+
+	// only a bare `~` is returned exactly as Dir reports it, anything after
+	// the tilde (even a lone separator) gives a cleaned path
+	result.Path = dir
+	if path != "~" {
+		result.Path = filepath.Join(dir, rest)
+	}
+
+	if caching() {
+		expandCache.Store(expandCacheEntry{input: path, home: dir, output: result.Path})
+	}
+	if intern {
+		expandIntern.add(key, result.Path)
+	}
+	return result, nil
 }
 
-// SetCacheEnable enables or disables caching of the home directory.
-// By default, caching is enabled.
-func SetCacheEnable(enable bool) {
-	cacheEnabled.Store(enable)
+// SetDirStack sets the directory stack that `~+N` and `~-N` paths are
+// expanded against, as an extension for tools emulating a shell. Like the
+// output of bash's `dirs`, the first element is the top of the stack: `~+N`
+// expands to the Nth element counting from the top (starting at zero) and
+// `~-N` to the Nth element counting from the bottom. Expanding such a path
+// is an error if the index is out of range or no stack is set (the default).
+// Passing nil removes the stack.
+func SetDirStack(stack []string) {
+	if stack != nil {
+		stack = append([]string{}, stack...)
+	}
+	dirStack.Store(stack)
 }
 
-func CacheEnabled() bool {
-	return cacheEnabled.Load()
+// dirStackIndex parses the `+N`/`-N` username of a directory stack tilde
+// prefix into an index from the top (positive) or from the bottom (negative,
+// offset by one so that `-0` is distinct from `+0`).
+func dirStackIndex(username string) (int, bool) {
+	if len(username) < 2 || (username[0] != '+' && username[0] != '-') || strings.Trim(username[1:], "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(username[1:])
+	if err != nil {
+		return 0, false
+	}
+	if username[0] == '-' {
+		return -n - 1, true
+	}
+	return n, true
 }
 
-// Dir returns the home directory for the executing user.
+func dirStackEntry(index int) (string, error) {
+	stack := dirStack.Load().([]string)
+	if stack == nil {
+		return "", errors.New("no directory stack set")
+	}
+	i := index
+	if index < 0 {
+		i = len(stack) + index
+	}
+	if i < 0 || i >= len(stack) {
+		return "", fmt.Errorf("directory stack index out of range (stack has %d entries)", len(stack))
+	}
+	return stack[i], nil
+}
+
+// ExpandPlan reports how Expand would expand the path without performing
+// the join: the home directory that would be used, the remaining path
+// relative to it, and whether the path is prefixed with `~` at all. For a
+// path without a `~` prefix the home is empty and rest is the path as-is.
+// Expand returns filepath.Join(home, rest) for tilde paths.
+func ExpandPlan(path string) (home string, rest string, usesTilde bool, err error) {
+	if !IsTilde(path) {
+		return "", path, false, nil
+	}
+
+	_, home, rest, err = planTilde(path, expandHooks{})
+	if err != nil {
+		return "", "", true, err
+	}
+	return home, rest, true, nil
+}
+
+// planTilde resolves the home directory for a tilde path, returning the
+// username (if any), the home directory and the remaining path. The username
+// is returned even when resolving the home directory fails.
+func planTilde(path string, hooks expandHooks) (username, home, rest string, err error) {
+	username, rest = splitTilde(path)
+
+	if username == "" {
+		dir := Dir
+		if hooks.home != nil {
+			dir = hooks.home
+		}
+		if home, err = dir(); err != nil {
+			if !errors.Is(err, ErrNoHomeDir) {
+				err = fmt.Errorf("%w: %w", ErrNoHomeDir, err)
+			}
+			err = fmt.Errorf("cannot expand %q: %w", path, err)
+		}
+	} else if hooks.resolve != nil {
+		if home, err = hooks.resolve(username); err != nil {
+			err = fmt.Errorf("cannot expand user-specific home dir %q: %w", path, err)
+		}
+	} else if index, ok := dirStackIndex(username); ok {
+		if home, err = dirStackEntry(index); err != nil {
+			err = fmt.Errorf("cannot expand %q: %w", path, err)
+		}
+	} else if registered, ok := registeredHome(username); ok {
+		home = registered
+	} else if strings.ContainsAny(username, invalidUsernameChars) {
+		err = fmt.Errorf("cannot expand %q: %w", path, ErrBadTilde)
+	} else if !expandUserLookup.Load() {
+		err = fmt.Errorf("cannot expand user-specific home dir %q: %w: %w", path, ErrUserLookupDisabled, ErrUnknownUser)
+	} else if home, err = DirFor(username); err != nil {
+		err = fmt.Errorf("cannot expand user-specific home dir %q: %w", path, err)
+	}
+	if err == nil {
+		// a home joined for another system is not checked against this one
+		home, err = absoluteHome(path, home, hooks.join != nil)
+	}
+	if err != nil {
+		return username, "", "", err
+	}
+
+	// only strip separators that filepath.Join would discard anyway
+	return username, home, strings.TrimLeft(rest, "/"+string(filepath.Separator)), nil
+}
+
+// absoluteHome checks that the home directory a path is expanded against is
+// absolute, making it absolute instead if enabled (see SetForceAbsoluteHome
+// and SetWindowsNormalizeDriveRoot). If foreign, the home is meant for another
+// system and may be absolute by either Unix or Windows rules.
+func absoluteHome(path, home string, foreign bool) (string, error) {
+	var err error
+	if !foreign {
+		if home, err = checkDriveRoot(runtime.GOOS, home); err != nil {
+			return "", fmt.Errorf("cannot expand %q: %w", path, err)
+		}
+	}
+	if filepath.IsAbs(home) || (foreign && isAbsAnyOS(home)) {
+		return home, nil
+	}
+	if !forceAbsoluteHome.Load() {
+		return "", fmt.Errorf("cannot expand %q: home directory %q is not absolute", path, home)
+	}
+	if home, err = filepath.Abs(home); err != nil {
+		return "", fmt.Errorf("cannot expand %q: %w", path, err)
+	}
+	return home, nil
+}
+
+// isAbsAnyOS reports whether path is absolute on Unix or Windows systems,
+// regardless of the OS at hand.
+func isAbsAnyOS(path string) bool {
+	if strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\\`) {
+		return true
+	}
+	return len(path) > 2 && isDriveOnly(path[:2]) && (path[2] == '/' || path[2] == '\\')
+}
+
+// splitTilde splits a tilde path into the username (empty for the current
+// user) and the remaining path, starting at the first separator.
+func splitTilde(path string) (username, rest string) {
+	if i := strings.IndexAny(path, `/\`); i >= 0 {
+		return path[1:i], path[i:]
+	}
+	return path[1:], ""
+}
+
+// ExpandClean is like Expand, but always returns a cleaned path (see
+// filepath.Clean), even when the path is not prefixed with `~`. This makes it
+// the canonical way to get consistent results for tilde and non-tilde paths,
+// e.g. with respect to duplicate separators. An empty path is returned as-is.
+func ExpandClean(path string) (string, error) {
+	expanded, err := Expand(path)
+	if err != nil || expanded == "" {
+		return expanded, err
+	}
+	return filepath.Clean(expanded), nil
+}
+
+// CleanExpand is like ExpandClean, but additionally verifies that a path
+// prefixed with `~` stays within the home directory it was expanded against,
+// returning an error for paths such as `~/../../etc` instead of silently
+// escaping it. `..` elements that stay within the home directory (e.g.
+// `~/a/../b`) are resolved as usual. Paths without a `~` prefix are only
+// cleaned. This is the recommended way to expand untrusted paths that are
+// meant to refer to files in the home directory.
+func CleanExpand(path string) (string, error) {
+	// the containment is checked before post-processing, which may move the path elsewhere
+	finish := func(result ExpandResult) (string, error) {
+		if result.Path == "" {
+			return "", nil
+		}
+		cleaned := filepath.Clean(result.Path)
+		if result.Home != "" {
+			if _, ok := relativeTo(result.Home, cleaned); !ok {
+				return "", fmt.Errorf("path %q escapes home directory %q", path, result.Home)
+			}
+		}
+		return cleaned, nil
+	}
+
+	result, err := expandRich(path, expandHooks{finish: finish})
+	if err != nil {
+		return "", err
+	}
+	return result.Path, nil
+}
+
+// ExpandAbs is like Expand, but additionally makes the result absolute (see
+// filepath.Abs), so relative paths are resolved against the current working
+// directory. An empty path is returned as-is.
+func ExpandAbs(path string) (string, error) {
+	expanded, err := Expand(path)
+	if err != nil || expanded == "" {
+		return expanded, err
+	}
+	return filepath.Abs(expanded)
+}
+
+// ExpandSplit is like Expand, but splits the result into a directory and a
+// file name component (see filepath.Split). Note that expanded tilde paths are
+// cleaned, so a trailing separator is dropped: `~/a/` splits into `<home>/`
+// and `a`, just like `~/a`, and a bare `~` splits the home directory itself.
+func ExpandSplit(path string) (dir, file string, err error) {
+	expanded, err := Expand(path)
+	if err != nil {
+		return "", "", err
+	}
+	dir, file = filepath.Split(expanded)
+	return dir, file, nil
+}
+
+// ExpandWritable is like Expand, but additionally verifies that the parent
+// directory of the result exists and is writable by the current user, by
+// creating and removing a temporary file in it. This lets tools fail early
+// with a clear error before doing any work. Note that the check is only a
+// snapshot: permissions may change before the path is actually written to.
+func ExpandWritable(path string) (string, error) {
+	expanded, err := Expand(path)
+	if err != nil {
+		return "", err
+	}
+
+	parent := filepath.Dir(expanded)
+	info, err := os.Stat(parent)
+	if err != nil {
+		return "", fmt.Errorf("parent directory of %q is not accessible: %w", expanded, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("parent of %q is not a directory", expanded)
+	}
+
+	f, err := os.CreateTemp(parent, ".homedir-write-check-*")
+	if err != nil {
+		return "", fmt.Errorf("parent directory of %q is not writable: %w", expanded, err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	if err := os.Remove(name); err != nil {
+		return "", fmt.Errorf("cannot remove write check file %q: %w", name, err)
+	}
+	return expanded, nil
+}
+
+// ResolveHomeRelative is like Expand, but treats relative paths as relative
+// to the home directory rather than the working directory: `go/bin` resolves
+// to the same path as `~/go/bin`. Absolute and `~`-prefixed paths behave as in
+// Expand, and an empty path is returned as-is.
+func ResolveHomeRelative(path string) (string, error) {
+	if path == "" || IsTilde(path) || filepath.IsAbs(path) {
+		return Expand(path)
+	}
+
+	return Expand("~" + string(filepath.Separator) + path)
+}
+
+// ExpandFS expands the path (see Expand) and returns a file system rooted at
+// the result (see os.DirFS), e.g. for walking `~/dir` with fs.WalkDir. An
+// error is returned if the path cannot be expanded or is not a directory.
+func ExpandFS(path string) (fs.FS, error) {
+	expanded, err := Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(expanded)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", expanded)
+	}
+	return os.DirFS(expanded), nil
+}
+
+// ExpandAsHome is like Expand, but expands a leading `~` to the given home
+// directory instead of the detected one, without consulting or changing the
+// caches. Like with Expand, the home directory must be absolute (see
+// SetForceAbsoluteHome). This is the recommended way to expand paths
+// against a caller-supplied home, e.g. when acting on behalf of another user.
+// Since only a single home is known, `~user` paths are rejected.
+func ExpandAsHome(path, home string) (string, error) {
+	if IsTilde(path) && home == "" {
+		return "", errors.New("home must not be empty")
+	}
+
+	result, err := expandRich(path, expandHooks{
+		home: func() (string, error) {
+			return home, nil
+		},
+		resolve: func(string) (string, error) {
+			return "", errors.New("only the given home is known")
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.Path, nil
+}
+
+// ExpandUnderRoot is like Expand, but re-roots the home directory under root,
+// giving the path the home directory would have inside a mounted root
+// filesystem (e.g. `~/.bashrc` with root `/mnt/target` becomes
+// `/mnt/target/home/me/.bashrc`). This assumes the home directory is absolute
+// and identical inside the root, as homes (including `~user` homes) are still
+// resolved on the host. Paths without a `~` prefix are returned as-is.
+func ExpandUnderRoot(path, root string) (string, error) {
+	home, rest, usesTilde, err := ExpandPlan(path)
+	if err != nil || !usesTilde {
+		return rest, err
+	}
+
+	// drop the volume name (on Windows) and the leading separator
+	home = home[len(filepath.VolumeName(home)):]
+	return filepath.Join(root, home, rest), nil
+}
+
+// ExpandFunc is like Expand, but resolves the home directory of `~user` paths
+// (including the directory stack forms) with the given function instead of
+// looking up the user or consulting RegisterHome, e.g. to resolve homes from
+// a database or a test fixture. `~` paths still expand to the home directory
+// of the executing user (see Dir). All other settings of Expand apply, e.g.
+// the unknown-user policy applies to errors from resolve that wrap
+// ErrUnknownUser. A nil resolve function behaves exactly like Expand.
+func ExpandFunc(path string, resolve func(user string) (string, error)) (string, error) {
+	result, err := expandRich(path, expandHooks{resolve: resolve})
+	if err != nil {
+		return "", err
+	}
+	return result.Path, nil
+}
+
+// homeTokens are the leading tokens (besides `~`) that ExpandAny substitutes with the home directory.
+var homeTokens = []string{"${HOME}", "$HOME", "%USERPROFILE%"}
+
+// ExpandAny is like Expand, but additionally recognizes a leading `$HOME`,
+// `${HOME}` or `%USERPROFILE%` token (regardless of the OS) as a reference to
+// the home directory. Only a leading token that is followed by a path separator
+// or the end of the path is considered; everything else is handled by Expand.
+func ExpandAny(path string) (string, error) {
+	for _, token := range homeTokens {
+		if !strings.HasPrefix(path, token) {
+			continue
+		}
+		rest := path[len(token):]
+		if rest == "" || rest[0] == '/' || rest[0] == '\\' {
+			return Expand("~" + rest)
+		}
+	}
+	return Expand(path)
+}
+
+// ExpandShell is like Expand, but additionally supports the following subset
+// of shell parameter expansion, anywhere in the path:
 //
-// This uses an OS-specific method for discovering the home directory.
-// An error is returned if a home directory cannot be detected.
-func Dir() (string, error) {
-	if cacheEnabled.Load() {
-		cached := homedirCache.Load().(string)
-		if cached != "" {
-			return cached, nil
+//   - `${NAME:-word}` expands to the value of the environment variable NAME,
+//     or to word if NAME is unset or empty (e.g. `${HOME:-/tmp}`).
+//   - `${NAME:=word}` expands the same way. Unlike in a shell, NAME is not
+//     assigned.
+//
+// NAME must consist of letters, digits and underscores, not starting with a
+// digit, and word must not contain `}`. Anything else, including `$NAME` and
+// `${NAME}`, is left as-is. Like in a shell, the parameters are substituted
+// before a leading `~` is expanded, so the substituted values are cleaned
+// along with the rest of the path, and the post-processor and length limit
+// (see SetExpandPostProcessor and SetMaxPathLength) apply to the substituted
+// path. The tilde prefix itself is not subject to substitution, and a `~` in
+// a variable value or in word is not expanded.
+func ExpandShell(path string) (string, error) {
+	result, err := expandRich(path, expandHooks{substitute: substituteParameters})
+	if err != nil {
+		return "", err
+	}
+	return result.Path, nil
+}
+
+// substituteParameters substitutes the parameter expansions supported by
+// ExpandShell in s.
+func substituteParameters(s string) string {
+	var sb strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		value, ok := expandParameter(s[start+2 : end])
+		if !ok {
+			// not a supported form, keep it and continue after the `${`
+			sb.WriteString(s[:start+2])
+			s = s[start+2:]
+			continue
+		}
+		sb.WriteString(s[:start])
+		sb.WriteString(value)
+		s = s[end+1:]
+	}
+	sb.WriteString(s)
+	return sb.String()
+}
+
+// expandParameter expands the contents of a `${NAME:-word}` or `${NAME:=word}`
+// parameter expansion, reporting whether it is one of those forms.
+func expandParameter(param string) (string, bool) {
+	i := strings.IndexByte(param, ':')
+	if i < 1 || i+1 >= len(param) || (param[i+1] != '-' && param[i+1] != '=') {
+		return "", false
+	}
+
+	name := param[:i]
+	for j, c := range name {
+		letter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (j == 0 || c < '0' || c > '9') {
+			return "", false
 		}
 	}
 
-	dir, err := detectHomeDir()
+	if value := os.Getenv(name); value != "" {
+		return value, true
+	}
+	return param[i+2:], true
+}
+
+// ExpandPercent is like Expand, but first decodes a leading percent-encoded
+// tilde (`%7E` or `%7e`), as stored by some config formats, so that `%7E/x`
+// expands like `~/x`. Only that leading `%7E` is decoded: the rest of the path
+// is not URL-decoded, and a `%7E` anywhere else is left as-is.
+func ExpandPercent(path string) (string, error) {
+	if strings.HasPrefix(path, "%7E") || strings.HasPrefix(path, "%7e") {
+		path = "~" + path[3:]
+	}
+	return Expand(path)
+}
+
+// ExpandEscaped is like Expand, but treats a leading `\~` as an escaped
+// literal `~`: the backslash is stripped and the rest of the path is returned
+// without expansion (e.g. `\~config` becomes `~config`), though still
+// post-processed (see SetExpandPostProcessor). Only a leading backslash-tilde
+// is treated as an escape; anywhere else it is left as-is.
+func ExpandEscaped(path string) (string, error) {
+	if strings.HasPrefix(path, `\~`) {
+		return expandLiteral(path[1:])
+	}
+	return Expand(path)
+}
+
+// expandLiteral returns the path without expanding it, but otherwise like
+// Expand (e.g. post-processed), for escaped tildes.
+func expandLiteral(path string) (string, error) {
+	result, err := expandRich(path, expandHooks{literal: true})
 	if err != nil {
 		return "", err
 	}
+	return result.Path, nil
+}
 
-	if cacheEnabled.Load() {
-		homedirCache.Store(dir)
+// ExpandDoubleTilde is like Expand, but treats a leading `~~` as an escaped
+// literal `~`: it is collapsed to a single `~` and the rest of the path is
+// returned without expansion (e.g. `~~config` becomes `~config` and `~~`
+// becomes `~`). This is an alternative to the backslash escaping of
+// ExpandEscaped for config formats where backslashes are awkward. Only a
+// leading `~~` is treated as an escape; anywhere else it is left as-is.
+func ExpandDoubleTilde(path string) (string, error) {
+	if strings.HasPrefix(path, "~~") {
+		return expandLiteral(path[1:])
 	}
-	return dir, nil
+	return Expand(path)
 }
 
-// detectHomeDir tries to detect the user's home directory using various methods
-func detectHomeDir() (string, error) {
-	// always check with the standard lib approach first
-	dir, err := os.UserHomeDir()
-	if err == nil && dir != "" {
-		return dir, nil
+// ExpandQuoted is like Expand, but first strips a single layer of matching
+// surrounding quotes (either `"` or `'`), as some config loaders leave them
+// intact (e.g. `"~/x"`). Only one layer is stripped, so `"'~/x'"` yields
+// `'~/x'` unexpanded. Unquoted paths behave exactly as with Expand.
+func ExpandQuoted(path string) (string, error) {
+	if len(path) >= 2 {
+		if q := path[0]; (q == '"' || q == '\'') && path[len(path)-1] == q {
+			path = path[1 : len(path)-1]
+		}
+	}
+	return Expand(path)
+}
+
+// ExpandGlobList expands each pattern (see Expand) and returns the paths
+// matching any of them (see filepath.Glob), de-duplicated and sorted. Errors
+// for individual patterns are aggregated, in which case the matches of the
+// remaining patterns are still returned.
+func ExpandGlobList(patterns []string) ([]string, error) {
+	seen := make(map[string]struct{})
+	var errs []error
+	for _, pattern := range patterns {
+		expanded, err := Expand(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to expand pattern %q: %w", pattern, err))
+			continue
+		}
+
+		matches, err := filepath.Glob(expanded)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to glob pattern %q: %w", pattern, err))
+			continue
+		}
+		for _, match := range matches {
+			seen[match] = struct{}{}
+		}
 	}
 
-	// fall back to OS-specific methods
-	if runtime.GOOS == "windows" {
-		return dirWindows()
+	results := make([]string, 0, len(seen))
+	for match := range seen {
+		results = append(results, match)
 	}
-	return dirUnix(runtime.GOOS)
+	sort.Strings(results)
+
+	return results, errors.Join(errs...)
 }
 
-// Expand expands the path to include the home directory if the path
-// is prefixed with `~`. If it isn't prefixed with `~`, the path is
-// returned as-is.
-func Expand(path string) (string, error) {
-	if len(path) == 0 {
+// Contract is the inverse of Expand: if the path is the home directory or is
+// located under it, the home directory prefix is replaced with `~`. Any other
+// path is returned cleaned but otherwise as-is. An error is returned if the
+// home directory cannot be detected.
+func Contract(path string) (string, error) {
+	if path == "" {
 		return path, nil
 	}
 
-	if path[0] != '~' {
-		return path, nil
+	dir, err := Dir()
+	if err != nil {
+		return "", err
 	}
 
-	if len(path) > 1 && path[1] != '/' && path[1] != '\\' {
-		return "", errors.New("cannot expand user-specific home dir")
+	if contracted, ok := contractUnder(dir, path); ok {
+		return contracted, nil
 	}
+	return filepath.Clean(path), nil
+}
+
+// contractUnder replaces the home prefix of path with `~`, reporting whether
+// the path is the home directory or located under it.
+func contractUnder(home, path string) (string, bool) {
+	rel, ok := relativeTo(home, path)
+	if !ok {
+		return "", false
+	}
+	if rel == "." {
+		return "~", true
+	}
+	return "~" + string(filepath.Separator) + rel, true
+}
 
+// ContractMap returns a copy of m in which every value that is the home
+// directory or is located under it is contracted (see Contract), e.g. before
+// writing config values to disk. All other values, including ones that do not
+// look like paths, are left untouched (and are not cleaned). Keys are never
+// changed. An error is returned if the home directory cannot be detected.
+func ContractMap(m map[string]string) (map[string]string, error) {
 	dir, err := Dir()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	result := make(map[string]string, len(m))
+	for key, value := range m {
+		if contracted, ok := contractUnder(dir, value); ok {
+			value = contracted
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// ExpandMap returns a copy of m in which every value is expanded (see Expand),
+// e.g. right after loading config values; it is the counterpart of
+// ContractMap. Keys are never changed. Errors for individual values are
+// aggregated, in which case those values are left untouched.
+func ExpandMap(m map[string]string) (map[string]string, error) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	result := make(map[string]string, len(m))
+	for _, key := range keys {
+		expanded, err := Expand(m[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to expand value of %q: %w", key, err))
+			expanded = m[key]
+		}
+		result[key] = expanded
+	}
+	return result, errors.Join(errs...)
+}
+
+// Shrink is like Contract, but is meant for display purposes and never fails:
+// if the path is not under the home directory, or the home directory cannot be
+// detected, it is returned as-is (uncleaned).
+func Shrink(path string) string {
+	if path == "" {
+		return path
+	}
+	dir, err := Dir()
+	if err != nil {
+		return path
+	}
+	if contracted, ok := contractUnder(dir, path); ok {
+		return contracted
+	}
+	return path
+}
+
+// relativeTo returns the path relative to base, reporting whether the path is
+// base itself or located under it. This is purely lexical (see filepath.Rel).
+func relativeTo(base, path string) (string, bool) {
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// joinUnder joins sub onto base, returning an error if the result would escape base.
+func joinUnder(base, sub string) (string, error) {
+	joined := filepath.Join(base, sub)
+	if _, ok := relativeTo(base, joined); !ok {
+		return "", fmt.Errorf("path %q escapes %q", sub, base)
+	}
+	return joined, nil
+}
+
+// IsTilde reports whether Expand treats the path as a tilde path, that is,
+// whether it is `~`, `~/...`, `~\...` or a user-specific `~user...` form.
+func IsTilde(path string) bool {
+	return len(path) > 0 && path[0] == '~'
+}
+
+// ExpandList expands each element of a list of paths separated by
+// os.PathListSeparator (such as a PATH-style value) and rejoins them.
+// Empty elements are preserved as-is.
+func ExpandList(list string) (string, error) {
+	sep := string(os.PathListSeparator)
+	elements := strings.Split(list, sep)
+	for i, element := range elements {
+		expanded, err := Expand(element)
+		if err != nil {
+			return "", fmt.Errorf("unable to expand list element %d (%q): %w", i, element, err)
+		}
+		elements[i] = expanded
 	}
+	return strings.Join(elements, sep), nil
+}
 
-	return filepath.Join(dir, path[1:]), nil
+// ExpandLines copies r to w line by line, expanding every line that starts
+// with `~/`. Each such line is treated as a single path in its entirety (see
+// Expand), which suits simple path-list files with one path per line; nothing
+// within a line is expanded. All other lines, such as blank lines and `#`
+// comments, are copied as-is. Lines are written terminated by "\n".
+func ExpandLines(r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "~/") {
+			expanded, err := Expand(line)
+			if err != nil {
+				return fmt.Errorf("unable to expand line %d: %w", n, err)
+			}
+			line = expanded
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
 }
 
-// Reset clears the cache, forcing the next call to Dir to re-detect
-// the home directory. This generally never has to be called, but can be
-// useful in tests if you're modifying the home directory via the HOME
-// env var or something.
+// Reset clears all caches (including the per-user cache used by DirFor),
+// forcing the next call to Dir to re-detect the home directory. This
+// generally never has to be called, but can be useful in tests if you're
+// modifying the home directory via the HOME env var or something.
 func Reset() {
-	homedirCache.Store("")
+	homedirCache.Store(cacheEntry{})
+	homedirErrCache.Store(errCacheEntry{})
+	physicalCache.Store(physicalCacheEntry{})
+	expandCache.Store(expandCacheEntry{})
+	expandIntern.clear()
+	userCache.clear()
 }
 
 func dirUnix(goos string) (string, error) {
+	dir, _, err := runStrategies(goos, fallbackStrategies(goos))
+	return dir, err
+}
+
+// envUnix returns the home directory from the environment on non-Windows
+// systems. All of them (including less common ones such as haiku, illumos and
+// aix) use HOME, except for plan9.
+func envUnix(goos string) string {
 	homeEnv := "HOME"
 	if goos == "plan9" {
 		// on plan9, env vars are lowercase.
 		homeEnv = "home"
 	}
+	return os.Getenv(homeEnv)
+}
 
-	// first prefer the HOME environmental variable
-	if home := os.Getenv(homeEnv); home != "" {
-		return home, nil
+// currentUserHome looks up the home directory of the current user in the passwd database (swapped out in tests).
+var currentUserHome = getentHome
+
+// trustedGetent and trustedDscl are the standard locations of getent and
+// dscl, which are run instead of looking them up in $PATH when the
+// environment is ignored (see SetIgnoreEnv).
+const (
+	trustedGetent = "/usr/bin/getent"
+	trustedDscl   = "/usr/bin/dscl"
+)
+
+// trustedCommand returns a command running the user database tool at the
+// given trusted path, without passing on the environment.
+func trustedCommand(path string, args ...string) *exec.Cmd {
+	cmd := exec.Command(path, args...) //nolint:gosec
+	cmd.Env = []string{}
+	return cmd
+}
+
+// getentHome returns the home directory of the current user from the passwd
+// database (or the passwd file, see SetPasswdPath, if getent is unavailable).
+// This is the real user, unless the environment is ignored (see SetIgnoreEnv),
+// in which case it is the effective user and the trusted getent is run.
+func getentHome() (string, error) {
+	uid := strconv.Itoa(os.Getuid())
+	cmd := exec.Command("getent", "passwd", uid) //nolint:gosec
+	if ignoreEnv.Load() {
+		uid = strconv.Itoa(os.Geteuid())
+		cmd = trustedCommand(trustedGetent, "passwd", uid)
 	}
 
 	var stdout bytes.Buffer
-
-	// if that fails, try OS specific commands
-	if goos == "darwin" {
-		cmd := exec.Command("sh", "-c", `dscl -q . -read /Users/"$(whoami)" NFSHomeDirectory | sed 's/^[^ ]*: //'`)
-		cmd.Stdout = &stdout
-		if err := cmd.Run(); err == nil {
-			result := strings.TrimSpace(stdout.String())
-			if result != "" {
-				return result, nil
-			}
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			// getent exits with 2 when the key is not found in the database
+			return "", nil
 		}
-	} else {
-		cmd := exec.Command("getent", "passwd", strconv.Itoa(os.Getuid())) //nolint:gosec
-		cmd.Stdout = &stdout
-		if err := cmd.Run(); err != nil {
-			// if the error is ErrNotFound, we ignore it. Otherwise, return it.
-			if !errors.Is(err, exec.ErrNotFound) {
-				return "", err
-			}
-		} else {
-			if passwd := strings.TrimSpace(stdout.String()); passwd != "" {
-				// username:password:uid:gid:gecos:home:shell
-				passwdParts := strings.SplitN(passwd, ":", 7)
-				if len(passwdParts) > 5 {
-					return passwdParts[5], nil
-				}
-			}
+		// if getent is missing, we fall back to the passwd file. Otherwise, return the error.
+		if !errors.Is(err, exec.ErrNotFound) && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if entry, err := lookupPasswdFile(uid); err == nil {
+			return entry.home, nil
 		}
+		return "", nil
 	}
 
-	// if all else fails, try the shell
-	stdout.Reset()
+	if entry, ok := parsePasswdLine(stdout.String()); ok {
+		return entry.home, nil
+	}
+	return "", nil
+}
+
+// shellHome returns the home directory as reported by the shell, or an empty
+// string if it cannot be read.
+func shellHome() string {
+	var stdout bytes.Buffer
 	cmd := exec.Command("sh", "-c", "cd && pwd")
 	cmd.Stdout = &stdout
 	if err := cmd.Run(); err != nil {
-		return "", err
+		return ""
 	}
+	return strings.TrimSpace(stdout.String())
+}
 
-	result := strings.TrimSpace(stdout.String())
-	if result == "" {
-		return "", errors.New("blank output when reading home directory")
+// dsclHome returns the home directory of the current user as recorded by the
+// macOS directory services, or an empty string if it cannot be read. If the
+// environment is ignored (see SetIgnoreEnv), see trustedDsclHome.
+func dsclHome() string {
+	if ignoreEnv.Load() {
+		return trustedDsclHome()
 	}
 
-	return result, nil
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", `dscl -q . -read /Users/"$(whoami)" NFSHomeDirectory | sed 's/^[^ ]*: //'`)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(stdout.String())
+}
+
+// trustedDsclHome is like dsclHome, but looks up the effective user by uid
+// with the trusted dscl, without a shell or $PATH.
+func trustedDsclHome() string {
+	// the record name of the user, e.g. "alice  UniqueID = (\n 501\n)"
+	out, err := trustedCommand(trustedDscl, ".", "-search", "/Users", "UniqueID", strconv.Itoa(os.Geteuid())).Output()
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	// e.g. "NFSHomeDirectory: /Users/alice", with the value on the next line if it contains spaces
+	out, err = trustedCommand(trustedDscl, "-q", ".", "-read", "/Users/"+fields[0], "NFSHomeDirectory").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(out)), "NFSHomeDirectory:"))
 }
 
+// dirWindows is the fallback detection on Windows. Note that it only runs
+// after os.UserHomeDir, which already resolves USERPROFILE, so HOME is only
+// consulted here when USERPROFILE is unset.
 func dirWindows() (string, error) {
+	return windowsEnvHome(os.Getenv)
+}
+
+// envWindows is like dirWindows, but returns an empty string if none of the
+// environment variables name a home directory.
+func envWindows() string {
+	home, err := dirWindows()
+	if err != nil {
+		return ""
+	}
+	return home
+}
+
+func windowsEnvHome(getenv func(string) string) (string, error) {
 	// first prefer the HOME environmental variable
-	if home := os.Getenv("HOME"); home != "" {
+	if home := getenv("HOME"); home != "" {
 		return home, nil
 	}
 
 	// prefer standard environment variable USERPROFILE
-	if home := os.Getenv("USERPROFILE"); home != "" {
+	if home := getenv("USERPROFILE"); home != "" {
 		return home, nil
 	}
 
-	drive := os.Getenv("HOMEDRIVE")
-	path := os.Getenv("HOMEPATH")
+	drive := getenv("HOMEDRIVE")
+	path := getenv("HOMEPATH")
 	home := drive + path
 	if drive == "" || path == "" {
 		return "", errors.New("HOMEDRIVE, HOMEPATH, or USERPROFILE are blank")
@@ -0,0 +1,66 @@
+//go:build darwin
+
+package homedir
+
+import (
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// On macOS, sandboxed apps run with $HOME pointing at their container
+// (~/Library/Containers/<bundle id>/Data), which is where they are expected to
+// store their data. Since $HOME takes precedence during detection, Dir returns
+// the container path for such apps, unless SetDarwinUseLoginHome is enabled,
+// in which case the user's actual (login) home is returned instead. Use
+// SandboxHomeDir to find out whether the app appears to be sandboxed.
+
+// darwinUseLoginHome controls whether the directory services home is preferred over $HOME.
+var darwinUseLoginHome atomic.Bool
+
+// loginHome looks up the login home of the current user (swapped out in tests).
+var loginHome = dsclHome
+
+// SetDarwinUseLoginHome controls whether detection prefers the login home of the
+// current user, as recorded by the macOS directory services, over $HOME. This is
+// useful for GUI-launched or sandboxed apps where $HOME points into a container
+// but the user's actual home is needed. When the login home cannot be read,
+// detection falls back to the usual methods. By default, this is disabled.
+// Changing this setting clears the cache (see Reset).
+func SetDarwinUseLoginHome(enable bool) {
+	darwinUseLoginHome.Store(enable)
+	Reset()
+}
+
+// SandboxHomeDir returns the value of $HOME and whether the app appears to be
+// running in an App Sandbox, which is the case when $HOME points into a
+// container (i.e. contains `/Library/Containers/`). This is a heuristic that
+// helps apps decide where to store their data.
+func SandboxHomeDir() (string, bool) {
+	home := os.Getenv("HOME")
+	return home, isSandboxContainer(home)
+}
+
+func isSandboxContainer(home string) bool {
+	return strings.Contains(home, "/Library/Containers/")
+}
+
+func preferredHome() string {
+	if !darwinUseLoginHome.Load() {
+		return ""
+	}
+	return loginHome()
+}
+
+// platformState is the darwin-specific part of a State.
+type platformState struct {
+	useLoginHome bool
+}
+
+func snapshotPlatform() platformState {
+	return platformState{useLoginHome: darwinUseLoginHome.Load()}
+}
+
+func restorePlatform(s platformState) {
+	darwinUseLoginHome.Store(s.useLoginHome)
+}
@@ -0,0 +1,103 @@
+//go:build darwin
+
+package homedir
+
+import "testing"
+
+func TestSetDarwinUseLoginHome(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(false)
+
+	origLoginHome := loginHome
+	t.Cleanup(func() {
+		loginHome = origLoginHome
+		SetDarwinUseLoginHome(false)
+	})
+
+	container := "/Users/alice/Library/Containers/com.example.app/Data"
+	patchEnv(t, "HOME", container)
+
+	tests := []struct {
+		name      string
+		enable    bool
+		loginHome string
+		expected  string
+	}{
+		{
+			name:      "disabled uses HOME",
+			enable:    false,
+			loginHome: "/Users/alice",
+			expected:  container,
+		},
+		{
+			name:      "enabled prefers login home",
+			enable:    true,
+			loginHome: "/Users/alice",
+			expected:  "/Users/alice",
+		},
+		{
+			name:      "enabled falls back to HOME when lookup fails",
+			enable:    true,
+			loginHome: "",
+			expected:  container,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetDarwinUseLoginHome(tc.enable)
+			loginHome = func() string { return tc.loginHome }
+
+			dir, err := Dir()
+			if err != nil {
+				t.Fatalf("Dir() failed: %s", err)
+			}
+			if dir != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, dir)
+			}
+		})
+	}
+}
+
+func TestSandboxHomeDir(t *testing.T) {
+	tests := []struct {
+		name      string
+		home      string
+		sandboxed bool
+	}{
+		{
+			name:      "container home",
+			home:      "/Users/alice/Library/Containers/com.example.app/Data",
+			sandboxed: true,
+		},
+		{
+			name:      "regular home",
+			home:      "/Users/alice",
+			sandboxed: false,
+		},
+		{
+			name:      "containers dir without a container",
+			home:      "/Users/alice/Library/Containers",
+			sandboxed: false,
+		},
+		{
+			name:      "empty home",
+			home:      "",
+			sandboxed: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patchEnv(t, "HOME", tc.home)
+
+			home, sandboxed := SandboxHomeDir()
+			if home != tc.home {
+				t.Errorf("expected home %q, got %q", tc.home, home)
+			}
+			if sandboxed != tc.sandboxed {
+				t.Errorf("expected sandboxed %v, got %v", tc.sandboxed, sandboxed)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !darwin
+
+package homedir
+
+func preferredHome() string {
+	return ""
+}
+
+// platformState is the platform-specific part of a State (there is none on this platform).
+type platformState struct{}
+
+func snapshotPlatform() platformState {
+	return platformState{}
+}
+
+func restorePlatform(platformState) {}
@@ -1,11 +1,23 @@
 package homedir
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 // patchEnv modifies an environment variable for the duration of the test
@@ -28,14 +40,13 @@ func patchEnv(t testing.TB, key, value string) {
 	})
 }
 
-// restoreCache ensures cache settings are restored after test
+// restoreCache ensures cache settings (and all other configuration) are restored after test
 func restoreCache(t testing.TB) {
 	t.Helper()
-	origEnabled := CacheEnabled()
+	state := Snapshot()
 
 	t.Cleanup(func() {
-		SetCacheEnable(origEnabled)
-		Reset()
+		Restore(state)
 	})
 }
 
@@ -62,6 +73,56 @@ func TestCacheControl(t *testing.T) {
 	}
 }
 
+func TestDisableCache(t *testing.T) {
+	restoreCache(t)
+	t.Cleanup(func() { DisableCache = false })
+
+	// the signatures match mitchellh/go-homedir, so it can be swapped in
+	var (
+		_ func() (string, error)       = Dir
+		_ func(string) (string, error) = Expand
+		_ func()                       = Reset
+	)
+
+	original := detect
+	t.Cleanup(func() { detect = original })
+	attempts := 0
+	detect = func() (string, error) {
+		attempts++
+		return "/compat/home", nil
+	}
+
+	SetCacheEnable(true)
+	ClearHomeDir()
+	Reset()
+
+	DisableCache = true
+	if CacheEnabled() {
+		t.Error("expected CacheEnabled() to report false with DisableCache set")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := Dir(); err != nil {
+			t.Fatalf("Dir() failed: %s", err)
+		}
+	}
+	if attempts != 2 {
+		t.Errorf("expected detection on every call with DisableCache set, got %d attempts", attempts)
+	}
+	if _, _, ok := DirCached(); ok {
+		t.Error("expected nothing to be cached with DisableCache set")
+	}
+
+	DisableCache = false
+	for i := 0; i < 2; i++ {
+		if _, err := Dir(); err != nil {
+			t.Fatalf("Dir() failed: %s", err)
+		}
+	}
+	if attempts != 3 {
+		t.Errorf("expected a single detection once DisableCache is unset, got %d attempts", attempts-2)
+	}
+}
+
 func TestDir(t *testing.T) {
 	restoreCache(t)
 
@@ -127,254 +188,4298 @@ func TestDir(t *testing.T) {
 	}
 }
 
-func TestDetectHomeDir(t *testing.T) {
+func TestSetCacheErrors(t *testing.T) {
 	restoreCache(t)
+	SetCacheEnable(true)
 
-	dir, err := detectHomeDir()
-	if err != nil {
-		t.Fatalf("detectHomeDir() failed: %s", err)
-	}
+	origDetect := detect
+	t.Cleanup(func() {
+		detect = origDetect
+		SetCacheErrors(false)
+	})
 
-	if dir == "" {
-		t.Error("detectHomeDir() returned empty string")
+	var attempts int
+	detectErr := errors.New("no home")
+	detect = func() (string, error) {
+		attempts++
+		return "", detectErr
 	}
-}
-
-func TestDirWindows(t *testing.T) {
-	restoreCache(t)
 
 	tests := []struct {
-		name        string
-		env         map[string]string
-		expected    string
-		expectError bool
+		name             string
+		cacheErrors      bool
+		expectedAttempts int
 	}{
-		{
-			name: "home env var",
-			env: map[string]string{
-				"HOME":        "/windows/home",
-				"USERPROFILE": "",
-				"HOMEDRIVE":   "",
-				"HOMEPATH":    "",
-			},
-			expected: "/windows/home",
-		},
-		{
-			name: "userprofile env var",
-			env: map[string]string{
-				"HOME":        "",
-				"USERPROFILE": "/windows/userprofile",
-				"HOMEDRIVE":   "",
-				"HOMEPATH":    "",
-			},
-			expected: "/windows/userprofile",
-		},
-		{
-			name: "homedrive + homepath",
-			env: map[string]string{
-				"HOME":        "",
-				"USERPROFILE": "",
-				"HOMEDRIVE":   "C:",
-				"HOMEPATH":    "\\windows\\drive",
-			},
-			expected: "C:\\windows\\drive",
-		},
-		{
-			name: "no env vars set",
-			env: map[string]string{
-				"HOME":        "",
-				"USERPROFILE": "",
-				"HOMEDRIVE":   "",
-				"HOMEPATH":    "",
-			},
-			expected:    "",
-			expectError: true,
-		},
+		{"errors not cached", false, 3},
+		{"errors cached", true, 1},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			for k, v := range tc.env {
-				patchEnv(t, k, v)
-			}
+			SetCacheErrors(tc.cacheErrors)
+			Reset()
+			attempts = 0
 
-			dir, err := dirWindows()
-			if tc.expectError {
-				if err == nil {
-					t.Error("expected error but got none")
-				}
-			} else {
-				if err != nil {
-					t.Fatalf("unexpected error: %s", err)
-				}
-				if dir != tc.expected {
-					t.Errorf("expected %q, got %q", tc.expected, dir)
+			for i := 0; i < 3; i++ {
+				if _, err := Dir(); !errors.Is(err, detectErr) {
+					t.Fatalf("expected error %v, got %v", detectErr, err)
 				}
 			}
+
+			if attempts != tc.expectedAttempts {
+				t.Errorf("expected %d detection attempts, got %d", tc.expectedAttempts, attempts)
+			}
+
+			// a reset always forces another attempt
+			Reset()
+			if _, err := Dir(); !errors.Is(err, detectErr) {
+				t.Fatalf("expected error %v, got %v", detectErr, err)
+			}
+			if attempts != tc.expectedAttempts+1 {
+				t.Errorf("expected %d detection attempts after reset, got %d", tc.expectedAttempts+1, attempts)
+			}
 		})
 	}
+
+	t.Run("environment changes", func(t *testing.T) {
+		SetCacheErrors(true)
+		SetCacheRevalidate(true)
+		t.Cleanup(func() {
+			SetCacheRevalidate(false)
+		})
+		Reset()
+		attempts = 0
+
+		patchEnv(t, "HOME", "")
+		if _, err := Dir(); !errors.Is(err, detectErr) {
+			t.Fatalf("expected error %v, got %v", detectErr, err)
+		}
+		// a cached error is only returned for the environment it occurred in
+		patchEnv(t, "HOME", "/home/fixed")
+		if _, err := Dir(); !errors.Is(err, detectErr) {
+			t.Fatalf("expected error %v, got %v", detectErr, err)
+		}
+		if attempts != 2 {
+			t.Errorf("expected the changed environment to force another attempt, got %d attempts", attempts)
+		}
+	})
 }
 
-func TestDirUnix(t *testing.T) {
-	tests := []struct {
-		name        string
-		goos        string
-		env         map[string]string
-		expected    string
-		expectError bool
-		skipOnOS    string
-	}{
-		{
-			name: "linux with HOME",
-			goos: "linux",
-			env: map[string]string{
-				"HOME": "/unix/home",
-			},
-			expected:    "/unix/home",
-			expectError: false,
-		},
-		{
-			name: "darwin with HOME",
-			goos: "darwin",
-			env: map[string]string{
-				"HOME": "/darwin/home",
-			},
-			expected:    "/darwin/home",
-			expectError: false,
-		},
-		{
-			name: "plan9 with home",
-			goos: "plan9",
-			env: map[string]string{
-				"home": "/plan9/home",
-			},
-			expected:    "/plan9/home",
-			expectError: false,
-		},
-		{
-			name:        "empty HOME on unix",
-			goos:        "linux",
-			env:         map[string]string{"HOME": ""},
-			expected:    "",
-			expectError: false,     // not asserting error because fallbacks may work
-			skipOnOS:    "windows", // skip on Windows
-		},
-	}
+func TestSetCacheRevalidate(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(true)
+	t.Cleanup(func() {
+		SetCacheRevalidate(false)
+	})
 
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			if tc.skipOnOS != "" && runtime.GOOS == tc.skipOnOS {
-				t.Skipf("skipping %s on %s", tc.name, tc.skipOnOS)
-			}
+	origDetect := detect
+	t.Cleanup(func() {
+		detect = origDetect
+	})
 
-			for k, v := range tc.env {
-				patchEnv(t, k, v)
-			}
+	var attempts int
+	detect = func() (string, error) {
+		attempts++
+		return "/home/" + strconv.Itoa(attempts), nil
+	}
 
-			dir, err := dirUnix(tc.goos)
+	vars := ConsultedEnvVars()
+	for _, name := range vars {
+		patchEnv(t, name, "")
+	}
 
-			if tc.expectError {
-				if err == nil {
-					t.Error("expected error but got none")
-				}
-				return
-			}
+	assertDir := func(t *testing.T, expected string) {
+		t.Helper()
+		dir, err := Dir()
+		if err != nil {
+			t.Fatalf("Dir() failed: %s", err)
+		}
+		if dir != expected {
+			t.Errorf("expected %q, got %q", expected, dir)
+		}
+	}
 
-			// if we don't expect error but got one, it might be ok for some cases
-			// where we're not testing error conditions explicitly
-			if err != nil && tc.expected != "" {
-				t.Fatalf("unexpected error: %s", err)
-			}
+	// without revalidation env changes are ignored
+	Reset()
+	assertDir(t, "/home/1")
+	patchEnv(t, vars[0], "/changed")
+	assertDir(t, "/home/1")
 
-			// only verify the output if we have an expected value and no error
-			if tc.expected != "" && err == nil {
-				if dir != tc.expected {
-					t.Errorf("expected %q, got %q", tc.expected, dir)
-				}
-			}
-		})
+	// with revalidation, a stale fingerprint triggers detection once
+	SetCacheRevalidate(true)
+	assertDir(t, "/home/2")
+	assertDir(t, "/home/2")
+
+	// every consulted var is part of the fingerprint
+	for i, name := range vars {
+		patchEnv(t, name, "/changed/again")
+		assertDir(t, "/home/"+strconv.Itoa(i+3))
+		assertDir(t, "/home/"+strconv.Itoa(i+3))
 	}
+
+	// unrelated env vars are not
+	patchEnv(t, "HOMEDIR_UNRELATED_VAR", "value")
+	assertDir(t, "/home/"+strconv.Itoa(len(vars)+2))
 }
 
-func TestExpand(t *testing.T) {
+func TestDirCached(t *testing.T) {
 	restoreCache(t)
 
-	u, err := user.Current()
-	if err != nil {
-		t.Fatalf("failed to get current user: %s", err)
+	original := detect
+	t.Cleanup(func() { detect = original })
+	attempts := 0
+	detect = func() (string, error) {
+		attempts++
+		return "/cached/home", nil
 	}
 
-	tests := []struct {
-		name   string
-		input  string
-		output string
-		err    bool
-	}{
-		{
-			name:   "non-tilde path",
-			input:  "/foo",
-			output: "/foo",
-			err:    false,
-		},
-		{
-			name:   "tilde with path",
-			input:  "~/foo",
-			output: filepath.Join(u.HomeDir, "foo"),
-			err:    false,
-		},
-		{
-			name:   "empty path",
-			input:  "",
-			output: "",
-			err:    false,
-		},
-		{
-			name:   "tilde only",
-			input:  "~",
-			output: u.HomeDir,
-			err:    false,
-		},
-		{
-			name:   "tilde with user",
-			input:  "~user/foo",
-			output: "",
-			err:    true,
-		},
+	SetCacheEnable(true)
+	ClearHomeDir()
+	Reset()
+
+	if _, _, ok := DirCached(); ok {
+		t.Fatal("expected nothing to be cached after reset")
+	}
+	if attempts != 0 {
+		t.Fatalf("expected DirCached not to run detection, got %d attempts", attempts)
 	}
 
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			actual, err := Expand(tc.input)
-			if (err != nil) != tc.err {
-				t.Fatalf("Expand(%q) error: got %v, want error: %v", tc.input, err, tc.err)
-			}
+	if _, err := Dir(); err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
 
-			if actual != tc.output {
-				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
-			}
-		})
+	dir, age, ok := DirCached()
+	if !ok || dir != "/cached/home" {
+		t.Fatalf("expected cached %q, got %q (ok: %v)", "/cached/home", dir, ok)
+	}
+	if age < 0 || age > time.Minute {
+		t.Errorf("expected a small non-negative age, got %s", age)
+	}
+	if attempts != 1 {
+		t.Errorf("expected a single detection attempt, got %d", attempts)
 	}
 
-	// test with cache disabled and custom home
-	t.Run("custom home with disabled cache", func(t *testing.T) {
-		SetCacheEnable(false)
-		homeEnv := "HOME"
+	SetCacheEnable(false)
+	if _, _, ok := DirCached(); ok {
+		t.Error("expected nothing to be reported with caching disabled")
+	}
+}
+
+func TestDirPhysical(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(true)
+
+	tmp := t.TempDir()
+	realA := filepath.Join(tmp, "a")
+	realB := filepath.Join(tmp, "b")
+	for _, dir := range []string{realA, realB} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(tmp, "home")
+	if err := os.Symlink(realA, link); err != nil {
+		t.Skipf("symlinks not supported: %s", err)
+	}
+	SetHomeDir(link)
+
+	resolved := func(path string) string {
+		t.Helper()
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resolved
+	}
+
+	if actual, err := Dir(); err != nil || actual != link {
+		t.Errorf("Dir() = %q, want logical %q (err: %v)", actual, link, err)
+	}
+	if actual, err := DirPhysical(); err != nil || actual != resolved(realA) {
+		t.Errorf("DirPhysical() = %q, want %q (err: %v)", actual, resolved(realA), err)
+	}
+
+	// the physical path is cached until the cache is reset
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(realB, link); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := DirPhysical(); err != nil || actual != resolved(realA) {
+		t.Errorf("DirPhysical() = %q, want cached %q (err: %v)", actual, resolved(realA), err)
+	}
+	Reset()
+	if actual, err := DirPhysical(); err != nil || actual != resolved(realB) {
+		t.Errorf("DirPhysical() = %q after Reset, want %q (err: %v)", actual, resolved(realB), err)
+	}
+
+	// a different logical home is resolved again
+	SetHomeDir(realA)
+	if actual, err := DirPhysical(); err != nil || actual != resolved(realA) {
+		t.Errorf("DirPhysical() = %q after home change, want %q (err: %v)", actual, resolved(realA), err)
+	}
+
+	SetHomeDir(filepath.Join(tmp, "missing"))
+	if _, err := DirPhysical(); err == nil {
+		t.Error("expected an error for a missing home directory")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	restoreCache(t)
+	t.Cleanup(ResetStats)
+
+	original := detect
+	t.Cleanup(func() { detect = original })
+	detect = func() (string, error) { return "/stats/home", nil }
+
+	ClearHomeDir()
+	Reset()
+	ResetStats()
+
+	assertStats := func(t *testing.T, expectedHits, expectedMisses uint64) {
+		t.Helper()
+		if hits, misses := CacheStats(); hits != expectedHits || misses != expectedMisses {
+			t.Errorf("expected %d hits and %d misses, got %d hits and %d misses", expectedHits, expectedMisses, hits, misses)
+		}
+	}
+
+	SetCacheEnable(true)
+	for i := 0; i < 3; i++ {
+		if _, err := Dir(); err != nil {
+			t.Fatalf("Dir() failed: %s", err)
+		}
+	}
+	assertStats(t, 2, 1)
+
+	SetCacheEnable(false)
+	for i := 0; i < 2; i++ {
+		if _, err := Dir(); err != nil {
+			t.Fatalf("Dir() failed: %s", err)
+		}
+	}
+	assertStats(t, 2, 3)
+
+	// overrides bypass the cache entirely
+	SetHomeDir("/override")
+	if _, err := Dir(); err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+	assertStats(t, 2, 3)
+
+	ResetStats()
+	assertStats(t, 0, 0)
+}
+
+func TestExpandCounters(t *testing.T) {
+	restoreCache(t)
+	t.Cleanup(ResetStats)
+	SetHomeDir("/home/me")
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1001", home: "/home/alice"})
+	ResetStats()
+
+	paths := []string{
+		"~", "~/a", "~/b", // tilde
+		"~alice/x",        // user
+		"/abs", "rel", "", // passthrough
+		"~bob/x", // error, not counted
+	}
+	for _, path := range paths {
+		_, _ = Expand(path)
+	}
+
+	assertCounters := func(t *testing.T, expectedTilde, expectedUser, expectedPassthrough uint64) {
+		t.Helper()
+		tilde, user, passthrough := ExpandCounters()
+		if tilde != expectedTilde || user != expectedUser || passthrough != expectedPassthrough {
+			t.Errorf("ExpandCounters() = %d, %d, %d, want %d, %d, %d", tilde, user, passthrough, expectedTilde, expectedUser, expectedPassthrough)
+		}
+	}
+	assertCounters(t, 3, 1, 3)
+
+	// unknown users left unexpanded are passed through
+	SetUnknownUserPolicy(UnknownUserPassthrough)
+	if _, err := Expand("~bob/x"); err != nil {
+		t.Fatalf("Expand() failed: %s", err)
+	}
+	assertCounters(t, 3, 1, 4)
+
+	ResetStats()
+	assertCounters(t, 0, 0, 0)
+}
+
+func TestDirConcurrentStress(t *testing.T) {
+	restoreCache(t)
+	ClearHomeDir()
+
+	original := detect
+	t.Cleanup(func() { detect = original })
+	detect = func() (string, error) { return os.Getenv("HOME"), nil }
+
+	homes := map[string]bool{"/stress/a": true, "/stress/b": true}
+	patchEnv(t, "HOME", "/stress/a")
+
+	var (
+		wg   sync.WaitGroup
+		stop atomic.Bool
+	)
+
+	// flip the environment and the cache settings while readers are running
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			if i%2 == 0 {
+				os.Setenv("HOME", "/stress/a")
+			} else {
+				os.Setenv("HOME", "/stress/b")
+			}
+			SetCacheRevalidate(i%3 != 0)
+			SetCacheEnable(i%5 != 0)
+			SetExpandCacheSize(i % 4)
+			if i%7 == 0 {
+				Reset()
+			}
+		}
+	}()
+
+	errs := make(chan error, 1)
+	report := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	var readers sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; i < 500; i++ {
+				dir, err := Dir()
+				if err != nil || !homes[dir] {
+					report(fmt.Errorf("Dir() = %q, %v", dir, err))
+					return
+				}
+				if cached, age, ok := DirCached(); ok && (!homes[cached] || age < 0) {
+					report(fmt.Errorf("DirCached() = %q, %s", cached, age))
+					return
+				}
+				expanded, err := Expand("~/x")
+				if err != nil || !homes[filepath.ToSlash(filepath.Dir(expanded))] {
+					report(fmt.Errorf("Expand() = %q, %v", expanded, err))
+					return
+				}
+			}
+		}()
+	}
+
+	readers.Wait()
+	stop.Store(true)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		t.Error(err)
+	default:
+	}
+}
+
+func TestDirModTime(t *testing.T) {
+	restoreCache(t)
+
+	home := t.TempDir()
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(home, modTime, modTime); err != nil {
+		t.Fatalf("failed to set mod time: %s", err)
+	}
+	SetHomeDir(home)
+
+	actual, err := DirModTime()
+	if err != nil {
+		t.Fatalf("DirModTime() failed: %s", err)
+	}
+	if actual.IsZero() {
+		t.Error("expected a non-zero mod time")
+	}
+	if !actual.Equal(modTime) {
+		t.Errorf("expected %v, got %v", modTime, actual)
+	}
+
+	// a missing home is reported
+	SetHomeDir(filepath.Join(home, "missing"))
+	if _, err := DirModTime(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected error wrapping %v, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestSetStatFS(t *testing.T) {
+	restoreCache(t)
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	SetStatFS(fstest.MapFS{
+		"home/me":      &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: modTime},
+		"home/me/file": &fstest.MapFile{Data: []byte("x")},
+	})
+
+	tests := []struct {
+		name    string
+		home    string
+		exists  bool
+		modTime time.Time
+	}{
+		{
+			name:    "existing home",
+			home:    filepath.Join(string(filepath.Separator)+"home", "me"),
+			exists:  true,
+			modTime: modTime,
+		},
+		{
+			name: "missing home",
+			home: filepath.Join(string(filepath.Separator)+"home", "other"),
+		},
+		{
+			name: "home is a file",
+			home: filepath.Join(string(filepath.Separator)+"home", "me", "file"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetHomeDir(tc.home)
+
+			exists, err := HomeExists()
+			if err != nil {
+				t.Fatalf("HomeExists() failed: %s", err)
+			}
+			if exists != tc.exists {
+				t.Errorf("expected HomeExists() = %v, got %v", tc.exists, exists)
+			}
+
+			actual, err := DirModTime()
+			if tc.modTime.IsZero() {
+				return
+			}
+			if err != nil {
+				t.Fatalf("DirModTime() failed: %s", err)
+			}
+			if !actual.Equal(tc.modTime) {
+				t.Errorf("expected %v, got %v", tc.modTime, actual)
+			}
+		})
+	}
+
+	// the OS is used again once the file system is removed
+	SetStatFS(nil)
+	SetHomeDir(t.TempDir())
+	if exists, err := HomeExists(); err != nil || !exists {
+		t.Errorf("expected the real home to exist, got %v (err: %v)", exists, err)
+	}
+}
+
+// restoreWorkingDir ensures the working directory is restored after test
+func restoreWorkingDir(t testing.TB) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %s", err)
+	}
+
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Errorf("failed to restore working directory: %s", err)
+		}
+	})
+}
+
+func TestFreeze(t *testing.T) {
+	restoreCache(t)
+	t.Cleanup(func() {
+		// freezing is irreversible outside of tests
+		frozenHome.Store("")
+	})
+
+	patchEnv(t, "HOME", "/frozen/home")
+	patchEnv(t, "USERPROFILE", "/frozen/home")
+	ClearHomeDir()
+	Reset()
+
+	frozen, err := Freeze()
+	if err != nil {
+		t.Fatalf("Freeze() failed: %s", err)
+	}
+
+	patchEnv(t, "HOME", "/tampered/home")
+	patchEnv(t, "USERPROFILE", "/tampered/home")
+	Reset()
+	SetCacheEnable(false)
+	SetHomeDir("/override/home")
+
+	if dir, err := Dir(); err != nil || dir != frozen {
+		t.Errorf("expected frozen %q, got %q (err: %v)", frozen, dir, err)
+	}
+	if expanded, err := Expand("~/x"); err != nil || expanded != filepath.Join(frozen, "x") {
+		t.Errorf("expected %q, got %q (err: %v)", filepath.Join(frozen, "x"), expanded, err)
+	}
+	if again, err := Freeze(); err != nil || again != frozen {
+		t.Errorf("expected repeated Freeze to return %q, got %q (err: %v)", frozen, again, err)
+	}
+}
+
+func TestChdirHome(t *testing.T) {
+	restoreCache(t)
+	restoreWorkingDir(t)
+
+	home, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to resolve temp dir: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(home, "projects", "app"), 0o755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	SetHomeDir(home)
+
+	dir, err := ChdirHome()
+	if err != nil {
+		t.Fatalf("ChdirHome() failed: %s", err)
+	}
+	if dir != home {
+		t.Errorf("expected %q, got %q", home, dir)
+	}
+	if wd, _ := os.Getwd(); wd != home {
+		t.Errorf("expected working directory %q, got %q", home, wd)
+	}
+
+	tests := []struct {
+		name     string
+		sub      string
+		expected string
+		err      bool
+	}{
+		{
+			name:     "subdirectory",
+			sub:      filepath.Join("projects", "app"),
+			expected: filepath.Join(home, "projects", "app"),
+		},
+		{
+			name:     "benign parent reference",
+			sub:      filepath.Join("projects", "app", ".."),
+			expected: filepath.Join(home, "projects"),
+		},
+		{
+			name: "escaping parent reference",
+			sub:  filepath.Join("..", "other"),
+			err:  true,
+		},
+		{
+			name: "missing subdirectory",
+			sub:  "missing",
+			err:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.Chdir(home); err != nil {
+				t.Fatalf("failed to change directory: %s", err)
+			}
+
+			dir, err := ChdirHomeSub(tc.sub)
+			if (err != nil) != tc.err {
+				t.Fatalf("ChdirHomeSub(%q) error: got %v, want error: %v", tc.sub, err, tc.err)
+			}
+
+			wd, _ := os.Getwd()
+			if tc.err {
+				if wd != home {
+					t.Errorf("expected working directory to remain %q, got %q", home, wd)
+				}
+				return
+			}
+			if dir != tc.expected || wd != tc.expected {
+				t.Errorf("expected %q, got %q (working directory %q)", tc.expected, dir, wd)
+			}
+		})
+	}
+}
+
+func TestDirWithTimeout(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(true)
+	Reset()
+
+	origDetect := detect
+	t.Cleanup(func() {
+		detect = origDetect
+	})
+
+	release := make(chan struct{})
+	detect = func() (string, error) {
+		<-release
+		return "/slow/home", nil
+	}
+
+	_, err := DirWithTimeout(10 * time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error wrapping %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the late detection still populates the cache
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for homedirCache.Load().(cacheEntry).dir == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the cache to be populated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	dir, err := DirWithTimeout(time.Second)
+	if err != nil {
+		t.Fatalf("DirWithTimeout() failed: %s", err)
+	}
+	if dir != "/slow/home" {
+		t.Errorf("expected %q, got %q", "/slow/home", dir)
+	}
+}
+
+func TestSetHomeDir(t *testing.T) {
+	restoreCache(t)
+	t.Cleanup(ClearHomeDir)
+
+	SetCacheEnable(true)
+	Reset()
+
+	detected, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	override := filepath.Join("/opt", "kiosk", "home")
+	SetHomeDir(override)
+
+	assertHome := func(t *testing.T, expected string) {
+		t.Helper()
+		dir, err := Dir()
+		if err != nil {
+			t.Fatalf("Dir() failed: %s", err)
+		}
+		if dir != expected {
+			t.Errorf("expected home dir %q, got %q", expected, dir)
+		}
+
+		expanded, err := Expand("~/foo")
+		if err != nil {
+			t.Fatalf("Expand() failed: %s", err)
+		}
+		if want := filepath.Join(expected, "foo"); expanded != want {
+			t.Errorf("expected expanded path %q, got %q", want, expanded)
+		}
+	}
+
+	assertHome(t, override)
+
+	// env changes are ignored
+	homeEnv := "HOME"
+	if runtime.GOOS == "plan9" {
+		homeEnv = "home"
+	} else if runtime.GOOS == "windows" {
+		patchEnv(t, "USERPROFILE", "/invalid/profile")
+	}
+	patchEnv(t, homeEnv, "/invalid/path")
+	assertHome(t, override)
+
+	// the override survives a reset and a disabled cache
+	Reset()
+	assertHome(t, override)
+	SetCacheEnable(false)
+	assertHome(t, override)
+
+	// clearing the override returns to detection
+	SetCacheEnable(true)
+	ClearHomeDir()
+	dir, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+	if dir == override {
+		t.Errorf("expected override %q to be cleared (detected %q before override)", override, detected)
+	}
+}
+
+func TestParseHomeFlag(t *testing.T) {
+	restoreCache(t)
+
+	tests := []struct {
+		name      string
+		args      []string
+		remaining []string
+		ok        bool
+		home      string
+		err       bool
+	}{
+		{
+			name:      "equals form",
+			args:      []string{"build", "--home=/x", "-v"},
+			remaining: []string{"build", "-v"},
+			ok:        true,
+			home:      "/x",
+		},
+		{
+			name:      "separate value",
+			args:      []string{"--home", "/x", "build"},
+			remaining: []string{"build"},
+			ok:        true,
+			home:      "/x",
+		},
+		{
+			name:      "last flag wins",
+			args:      []string{"--home=/x", "--home", "/y"},
+			remaining: []string{},
+			ok:        true,
+			home:      "/y",
+		},
+		{
+			name:      "absent flag",
+			args:      []string{"build", "-v"},
+			remaining: []string{"build", "-v"},
+		},
+		{
+			name:      "after terminator",
+			args:      []string{"run", "--", "--home=/x"},
+			remaining: []string{"run", "--", "--home=/x"},
+		},
+		{
+			name:      "similar flag",
+			args:      []string{"--homedir=/x"},
+			remaining: []string{"--homedir=/x"},
+		},
+		{
+			name: "missing value",
+			args: []string{"build", "--home"},
+			err:  true,
+		},
+		{
+			name: "empty value",
+			args: []string{"--home="},
+			err:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetHomeDir("/original")
+
+			remaining, ok, err := ParseHomeFlag(tc.args)
+			if tc.err {
+				if err == nil {
+					t.Errorf("ParseHomeFlag(%q) = %q, %v, want error", tc.args, remaining, ok)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("ParseHomeFlag(%q) failed: %s", tc.args, err)
+				}
+				if !reflect.DeepEqual(remaining, tc.remaining) || ok != tc.ok {
+					t.Errorf("ParseHomeFlag(%q) = %q, %v, want %q, %v", tc.args, remaining, ok, tc.remaining, tc.ok)
+				}
+			}
+
+			expected := tc.home
+			if expected == "" {
+				expected = "/original"
+			}
+			if dir, err := Dir(); err != nil || dir != expected {
+				t.Errorf("Dir() = %q, want %q (err: %v)", dir, expected, err)
+			}
+		})
+	}
+}
+
+func TestSettersInvalidateCaches(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t,
+		passwdEntry{name: "svc", uid: strconv.Itoa(os.Getuid()), home: "/home/svc"},
+		passwdEntry{name: "alice", uid: "1000", home: "/home/alice"},
+	)
+
+	homeEnv := ConsultedEnvVars()[0]
+
+	tests := []struct {
+		name     string
+		input    string
+		setup    func(t *testing.T)
+		change   func(t *testing.T)
+		expected string
+	}{
+		{
+			name:     "SetHomeDir",
+			input:    "~/x",
+			change:   func(*testing.T) { SetHomeDir("/override") },
+			expected: filepath.Join("/override", "x"),
+		},
+		{
+			name:     "ClearHomeDir",
+			input:    "~/x",
+			setup:    func(*testing.T) { SetHomeDir("/override") },
+			change:   func(*testing.T) { ClearHomeDir() },
+			expected: filepath.Join("/new/home", "x"),
+		},
+		{
+			name:  "SetHomeValidator",
+			input: "~/x",
+			change: func(*testing.T) {
+				SetHomeValidator(func(path string) error {
+					if path == "/old/home" {
+						return errors.New("stale")
+					}
+					return nil
+				})
+			},
+			expected: filepath.Join("/new/home", "x"),
+		},
+		{
+			name:  "SetRespectSSHUser",
+			input: "~/x",
+			setup: func(t *testing.T) {
+				patchEnv(t, "SSH_USER", "alice")
+			},
+			change:   func(*testing.T) { SetRespectSSHUser(true) },
+			expected: filepath.Join("/home/alice", "x"),
+		},
+		{
+			name:     "RegisterHome",
+			input:    "~team/x",
+			setup:    func(*testing.T) { RegisterHome("team", "/srv/old-team") },
+			change:   func(*testing.T) { RegisterHome("team", "/srv/new-team") },
+			expected: filepath.Join("/srv/new-team", "x"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			state := Snapshot()
+			t.Cleanup(func() { Restore(state) })
+
+			SetCacheEnable(true)
+			patchEnv(t, homeEnv, "/old/home")
+			Reset()
+			if tc.setup != nil {
+				tc.setup(t)
+			}
+
+			// populate the home and expand caches
+			if _, err := Expand(tc.input); err != nil {
+				t.Fatalf("Expand() failed: %s", err)
+			}
+
+			// the env change alone is hidden by the cache
+			patchEnv(t, homeEnv, "/new/home")
+			tc.change(t)
+
+			actual, err := Expand(tc.input)
+			if err != nil {
+				t.Fatalf("Expand() failed: %s", err)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDetectHomeDir(t *testing.T) {
+	restoreCache(t)
+
+	dir, err := detectHomeDir()
+	if err != nil {
+		t.Fatalf("detectHomeDir() failed: %s", err)
+	}
+
+	if dir == "" {
+		t.Error("detectHomeDir() returned empty string")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	// the first consulted variable is always the one checked by os.UserHomeDir
+	patchEnv(t, ConsultedEnvVars()[0], "/detect/home")
+
+	dir, src, err := Detect()
+	if err != nil {
+		t.Fatalf("Detect() failed: %s", err)
+	}
+	if dir != "/detect/home" {
+		t.Errorf("expected %q, got %q", "/detect/home", dir)
+	}
+	if src != SourceStdlib {
+		t.Errorf("expected source %v, got %v", SourceStdlib, src)
+	}
+}
+
+func TestFallbackStrategiesSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		goos     string
+		env      map[string]string
+		expected []Source
+		skipOnOS string
+	}{
+		{
+			name:     "linux with HOME",
+			goos:     "linux",
+			env:      map[string]string{"HOME": "/unix/home"},
+			expected: []Source{SourceEnv},
+		},
+		{
+			name:     "plan9 with home",
+			goos:     "plan9",
+			env:      map[string]string{"home": "/plan9/home"},
+			expected: []Source{SourceEnv},
+		},
+		{
+			name: "windows with HOMEDRIVE and HOMEPATH",
+			goos: "windows",
+			env: map[string]string{
+				"HOME":        "",
+				"USERPROFILE": "",
+				"HOMEDRIVE":   "C:",
+				"HOMEPATH":    "\\windows\\drive",
+			},
+			expected: []Source{SourceEnv},
+		},
+		{
+			name:     "linux without HOME",
+			goos:     "linux",
+			env:      map[string]string{"HOME": ""},
+			expected: []Source{SourceGetent, SourceShell},
+			skipOnOS: "windows",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.skipOnOS != "" && runtime.GOOS == tc.skipOnOS {
+				t.Skipf("skipping %s on %s", tc.name, tc.skipOnOS)
+			}
+
+			for k, v := range tc.env {
+				patchEnv(t, k, v)
+			}
+
+			dir, src, err := runStrategies(tc.goos, fallbackStrategies(tc.goos))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if dir == "" {
+				t.Error("expected a home directory but got none")
+			}
+
+			for _, expected := range tc.expected {
+				if src == expected {
+					return
+				}
+			}
+			t.Errorf("expected source to be one of %v, got %v", tc.expected, src)
+		})
+	}
+}
+
+func TestSetHomeValidator(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(false)
+	t.Cleanup(func() {
+		SetHomeValidator(nil)
+	})
+
+	patchEnv(t, "HOME", "/stale/automount")
+
+	var candidates []string
+	errStale := errors.New("stale home")
+	SetHomeValidator(func(path string) error {
+		candidates = append(candidates, path)
+		if path == "/stale/automount" {
+			return errStale
+		}
+		return nil
+	})
+
+	list := []strategy{
+		{SourceEnv, func() (string, error) { return envUnix("linux"), nil }},
+		{SourceShell, func() (string, error) { return "/valid/home", nil }},
+	}
+
+	dir, src, err := runStrategies("linux", list)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if dir != "/valid/home" || src != SourceShell {
+		t.Errorf("expected %q from %v, got %q from %v", "/valid/home", SourceShell, dir, src)
+	}
+	if expected := []string{"/stale/automount", "/valid/home"}; !reflect.DeepEqual(candidates, expected) {
+		t.Errorf("expected candidates %v, got %v", expected, candidates)
+	}
+
+	// when every candidate is rejected the rejection is reported
+	_, _, err = runStrategies("linux", list[:1])
+	if !errors.Is(err, errStale) {
+		t.Errorf("expected error wrapping %v, got %v", errStale, err)
+	}
+
+	// the validator is consulted by Dir as well
+	SetHomeValidator(func(string) error { return errStale })
+	if dir, err := Dir(); err == nil {
+		t.Errorf("expected Dir() to fail when every candidate is rejected, got %q", dir)
+	}
+}
+
+func TestDetectionError(t *testing.T) {
+	restoreCache(t)
+	SetHomeValidator(nil)
+
+	empty := func() (string, error) { return "", nil }
+	list := []strategy{
+		{SourceStdlib, empty},
+		{SourceEnv, empty},
+		{SourceGetent, empty},
+		{SourceShell, empty},
+	}
+
+	_, src, err := runStrategies("linux", list)
+	if src != SourceNone {
+		t.Errorf("expected %v, got %v", SourceNone, src)
+	}
+	if !errors.Is(err, ErrNoHomeDir) {
+		t.Fatalf("expected error wrapping ErrNoHomeDir, got %v", err)
+	}
+
+	var detectionErr *DetectionError
+	if !errors.As(err, &detectionErr) {
+		t.Fatalf("expected a DetectionError, got %T", err)
+	}
+	if expected := []Source{SourceStdlib, SourceEnv, SourceGetent, SourceShell}; !reflect.DeepEqual(detectionErr.Attempted, expected) {
+		t.Errorf("expected attempted sources %v, got %v", expected, detectionErr.Attempted)
+	}
+	if detectionErr.GOOS != "linux" {
+		t.Errorf("expected GOOS %q, got %q", "linux", detectionErr.GOOS)
+	}
+	if expected := "unable to detect home directory on linux (tried stdlib, env, getent, shell)"; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+
+	t.Run("fully-empty env", func(t *testing.T) {
+		for _, name := range consultedEnvVars("plan9") {
+			patchEnv(t, name, "")
+		}
+		list := []strategy{{SourceEnv, func() (string, error) { return envUnix("plan9"), nil }}}
+
+		_, _, err := runStrategies("plan9", list)
+		if !errors.As(err, &detectionErr) || !reflect.DeepEqual(detectionErr.Attempted, []Source{SourceEnv}) {
+			t.Errorf("expected a DetectionError attempting %v, got %v", SourceEnv, err)
+		}
+	})
+}
+
+func TestSourceString(t *testing.T) {
+	tests := []struct {
+		src      Source
+		expected string
+	}{
+		{SourceNone, "none"},
+		{SourceLoginHome, "login-home"},
+		{SourceStdlib, "stdlib"},
+		{SourceEnv, "env"},
+		{SourceDirectoryServices, "directory-services"},
+		{SourceGetent, "getent"},
+		{SourceShell, "shell"},
+		{SourceSSHUser, "ssh-user"},
+		{SourcePrimaryEnv, "primary-env"},
+		{SourceServiceProfile, "service-profile"},
+		{SourceLogname, "logname"},
+		{SourceHermetic, "hermetic"},
+		{Source(99), "Source(99)"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.expected, func(t *testing.T) {
+			if actual := tc.src.String(); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDirWindows(t *testing.T) {
+	restoreCache(t)
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		expected    string
+		expectError bool
+	}{
+		{
+			name: "home env var",
+			env: map[string]string{
+				"HOME":        "/windows/home",
+				"USERPROFILE": "",
+				"HOMEDRIVE":   "",
+				"HOMEPATH":    "",
+			},
+			expected: "/windows/home",
+		},
+		{
+			name: "userprofile env var",
+			env: map[string]string{
+				"HOME":        "",
+				"USERPROFILE": "/windows/userprofile",
+				"HOMEDRIVE":   "",
+				"HOMEPATH":    "",
+			},
+			expected: "/windows/userprofile",
+		},
+		{
+			name: "homedrive + homepath",
+			env: map[string]string{
+				"HOME":        "",
+				"USERPROFILE": "",
+				"HOMEDRIVE":   "C:",
+				"HOMEPATH":    "\\windows\\drive",
+			},
+			expected: "C:\\windows\\drive",
+		},
+		{
+			name: "no env vars set",
+			env: map[string]string{
+				"HOME":        "",
+				"USERPROFILE": "",
+				"HOMEDRIVE":   "",
+				"HOMEPATH":    "",
+			},
+			expected:    "",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				patchEnv(t, k, v)
+			}
+
+			dir, err := dirWindows()
+			if tc.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if dir != tc.expected {
+					t.Errorf("expected %q, got %q", tc.expected, dir)
+				}
+			}
+		})
+	}
+}
+
+func TestSetHermeticFallback(t *testing.T) {
+	restoreCache(t)
+
+	// no env vars are set in the sandbox, so detection fails
+	for _, name := range []string{"HOME", "USERPROFILE", "HOMEDRIVE", "HOMEPATH"} {
+		patchEnv(t, name, "")
+	}
+	sandbox := func() (string, Source, error) {
+		return orHermetic(runStrategies("windows", fallbackStrategies("windows")))
+	}
+
+	if dir, _, err := sandbox(); err == nil {
+		t.Fatalf("expected detection to fail without a fallback, got %q", dir)
+	}
+
+	SetHermeticFallback("/scratch/home")
+	if dir, src, err := sandbox(); err != nil || dir != "/scratch/home" || src != SourceHermetic {
+		t.Errorf("expected %q from %s, got %q from %s (err: %v)", "/scratch/home", SourceHermetic, dir, src, err)
+	}
+
+	// the fallback never takes precedence over a detected home
+	patchEnv(t, "USERPROFILE", `C:\Users\me`)
+	if dir, src, err := sandbox(); err != nil || dir != `C:\Users\me` || src != SourceEnv {
+		t.Errorf("expected %q from %s, got %q from %s (err: %v)", `C:\Users\me`, SourceEnv, dir, src, err)
+	}
+	patchEnv(t, "USERPROFILE", "")
+
+	// an empty dir uses a directory under the temp dir, created on use
+	patchEnv(t, "TMPDIR", t.TempDir())
+	patchEnv(t, "TEMP", os.Getenv("TMPDIR"))
+	patchEnv(t, "TMP", os.Getenv("TMPDIR"))
+	SetHermeticFallback("")
+	dir, src, err := sandbox()
+	if err != nil || src != SourceHermetic {
+		t.Fatalf("expected a fallback from %s, got %q from %s (err: %v)", SourceHermetic, dir, src, err)
+	}
+	if filepath.Dir(dir) != os.TempDir() {
+		t.Errorf("expected a directory under %q, got %q", os.TempDir(), dir)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Errorf("expected %q to be created (err: %v)", dir, err)
+	}
+	if actual := Config().HermeticFallback; actual != dir {
+		t.Errorf("expected Config() to report %q, got %q", dir, actual)
+	}
+
+	if runtime.GOOS != "windows" {
+		// a directory planted by someone else is not used
+		if err := os.Chmod(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if dir, _, err := sandbox(); err == nil {
+			t.Errorf("expected a world-writable fallback to be rejected, got %q", dir)
+		}
+
+		if err := os.Remove(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(t.TempDir(), dir); err != nil {
+			t.Fatal(err)
+		}
+		if dir, _, err := sandbox(); err == nil {
+			t.Errorf("expected a symlinked fallback to be rejected, got %q", dir)
+		}
+	}
+
+	ClearHermeticFallback()
+	if dir, _, err := sandbox(); err == nil {
+		t.Errorf("expected detection to fail after clearing the fallback, got %q", dir)
+	}
+}
+
+func TestSetWindowsServiceProfileFallback(t *testing.T) {
+	restoreCache(t)
+
+	original := isLocalSystem
+	t.Cleanup(func() { isLocalSystem = original })
+
+	// a service running as LocalSystem without any of the usual env vars
+	for _, name := range []string{"HOME", "USERPROFILE", "HOMEDRIVE", "HOMEPATH"} {
+		patchEnv(t, name, "")
+	}
+	patchEnv(t, "SystemRoot", `D:\Windows`)
+
+	tests := []struct {
+		name        string
+		enable      bool
+		localSystem bool
+		expected    string
+		expectError bool
+	}{
+		{
+			name:        "service account",
+			enable:      true,
+			localSystem: true,
+			expected:    `D:\Windows\System32\config\systemprofile`,
+		},
+		{
+			name:        "fallback disabled",
+			enable:      false,
+			localSystem: true,
+			expectError: true,
+		},
+		{
+			name:        "not a service account",
+			enable:      true,
+			localSystem: false,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetWindowsServiceProfileFallback(tc.enable)
+			isLocalSystem = func() bool { return tc.localSystem }
+
+			dir, src, err := runStrategies("windows", fallbackStrategies("windows"))
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error but got %q", dir)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if dir != tc.expected || src != SourceServiceProfile {
+				t.Errorf("expected %q from %s, got %q from %s", tc.expected, SourceServiceProfile, dir, src)
+			}
+		})
+	}
+
+	t.Run("default system root", func(t *testing.T) {
+		SetWindowsServiceProfileFallback(true)
+		isLocalSystem = func() bool { return true }
+		patchEnv(t, "SystemRoot", "")
+
+		expected := `C:\Windows\System32\config\systemprofile`
+		if dir, err := serviceProfileHome(); err != nil || dir != expected {
+			t.Errorf("expected %q, got %q (err: %v)", expected, dir, err)
+		}
+	})
+
+	// the env vars still take precedence
+	SetWindowsServiceProfileFallback(true)
+	isLocalSystem = func() bool { return true }
+	patchEnv(t, "USERPROFILE", `C:\Users\svc`)
+	if dir, src, err := runStrategies("windows", fallbackStrategies("windows")); err != nil || dir != `C:\Users\svc` || src != SourceEnv {
+		t.Errorf("expected %q from %s, got %q from %s (err: %v)", `C:\Users\svc`, SourceEnv, dir, src, err)
+	}
+}
+
+func TestDirUnix(t *testing.T) {
+	tests := []struct {
+		name        string
+		goos        string
+		env         map[string]string
+		expected    string
+		expectError bool
+		skipOnOS    string
+	}{
+		{
+			name: "linux with HOME",
+			goos: "linux",
+			env: map[string]string{
+				"HOME": "/unix/home",
+			},
+			expected:    "/unix/home",
+			expectError: false,
+		},
+		{
+			name: "darwin with HOME",
+			goos: "darwin",
+			env: map[string]string{
+				"HOME": "/darwin/home",
+			},
+			expected:    "/darwin/home",
+			expectError: false,
+		},
+		{
+			name: "plan9 with home",
+			goos: "plan9",
+			env: map[string]string{
+				"home": "/plan9/home",
+			},
+			expected:    "/plan9/home",
+			expectError: false,
+		},
+		{
+			name: "haiku with HOME",
+			goos: "haiku",
+			env: map[string]string{
+				"HOME": "/boot/home",
+			},
+			expected:    "/boot/home",
+			expectError: false,
+		},
+		{
+			name: "illumos with HOME",
+			goos: "illumos",
+			env: map[string]string{
+				"HOME": "/export/home/illumos",
+			},
+			expected:    "/export/home/illumos",
+			expectError: false,
+		},
+		{
+			name: "aix with HOME",
+			goos: "aix",
+			env: map[string]string{
+				"HOME": "/home/aix",
+			},
+			expected:    "/home/aix",
+			expectError: false,
+		},
+		{
+			name: "uppercase HOME is not consulted on plan9",
+			goos: "plan9",
+			env: map[string]string{
+				"home": "/plan9/home",
+				"HOME": "/unix/home",
+			},
+			expected:    "/plan9/home",
+			expectError: false,
+		},
+		{
+			name:        "empty HOME on unix",
+			goos:        "linux",
+			env:         map[string]string{"HOME": ""},
+			expected:    "",
+			expectError: false,     // not asserting error because fallbacks may work
+			skipOnOS:    "windows", // skip on Windows
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.skipOnOS != "" && runtime.GOOS == tc.skipOnOS {
+				t.Skipf("skipping %s on %s", tc.name, tc.skipOnOS)
+			}
+
+			for k, v := range tc.env {
+				patchEnv(t, k, v)
+			}
+
+			dir, err := dirUnix(tc.goos)
+
+			if tc.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+
+			// if we don't expect error but got one, it might be ok for some cases
+			// where we're not testing error conditions explicitly
+			if err != nil && tc.expected != "" {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// only verify the output if we have an expected value and no error
+			if tc.expected != "" && err == nil {
+				if dir != tc.expected {
+					t.Errorf("expected %q, got %q", tc.expected, dir)
+				}
+			}
+		})
+	}
+}
+
+func TestFallbackStrategiesNotFound(t *testing.T) {
+	restoreCache(t)
+
+	original := currentUserHome
+	t.Cleanup(func() { currentUserHome = original })
+	currentUserHome = func() (string, error) { return "", nil }
+
+	// nothing names a home directory, and neither sh nor dscl can be run
+	for _, name := range []string{"HOME", "home", "USERPROFILE", "HOMEDRIVE", "HOMEPATH"} {
+		patchEnv(t, name, "")
+	}
+	patchEnv(t, "PATH", t.TempDir())
+
+	for _, goos := range []string{"linux", "darwin", "windows"} {
+		t.Run(goos, func(t *testing.T) {
+			list := fallbackStrategies(goos)
+			dir, _, err := runStrategies(goos, list)
+
+			var detectionErr *DetectionError
+			if !errors.As(err, &detectionErr) {
+				t.Fatalf("expected a DetectionError, got %q (err: %v)", dir, err)
+			}
+			if len(detectionErr.Attempted) != len(list) {
+				t.Errorf("expected all %d methods to be attempted, got %v", len(list), detectionErr.Attempted)
+			}
+		})
+	}
+}
+
+func TestSetIgnoreEnv(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "mallory", uid: "666", home: "/home/mallory"})
+
+	original := currentUserHome
+	t.Cleanup(func() { currentUserHome = original })
+	currentUserHome = func() (string, error) { return "/home/passwd", nil }
+
+	// an attacker controls the environment of a setuid program
+	patchEnv(t, "HOME", "/malicious")
+	patchEnv(t, "HOMEDIR_TEST_HOME", "/malicious")
+	patchEnv(t, "SSH_USER", "mallory")
+	patchEnv(t, "LOGNAME", "mallory")
+	SetPrimaryEnvVar("HOMEDIR_TEST_HOME")
+	SetRespectSSHUser(true)
+	SetLognameFallback(true)
+
+	if dir, _, err := runStrategies("linux", strategies("linux")); err != nil || dir == "/home/passwd" {
+		t.Fatalf("expected the environment to be honored by default, got %q (err: %v)", dir, err)
+	}
+
+	SetIgnoreEnv(true)
+	dir, src, err := runStrategies("linux", strategies("linux"))
+	if err != nil || dir != "/home/passwd" || src != SourceGetent {
+		t.Errorf("expected %q from %s, got %q from %s (err: %v)", "/home/passwd", SourceGetent, dir, src, err)
+	}
+
+	for _, s := range Config().DetectionOrder {
+		if usesEnv(s) {
+			t.Errorf("expected %s to be skipped", s)
+		}
+	}
+
+	// windows only has environment-based methods
+	if dir, _, err := runStrategies("windows", strategies("windows")); err == nil {
+		t.Errorf("expected detection to fail on windows, got %q", dir)
+	}
+
+	SetIgnoreEnv(false)
+	if dir, _, err := runStrategies("linux", strategies("linux")); err != nil || dir == "/home/passwd" {
+		t.Errorf("expected the environment to be honored again, got %q (err: %v)", dir, err)
+	}
+}
+
+func TestSetIgnoreEnvTrustedGetent(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" || runtime.GOOS == "plan9" {
+		t.Skipf("getent is not used on %s", runtime.GOOS)
+	}
+	restoreCache(t)
+
+	// a getent planted in $PATH
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho 'root:x:0:0::/malicious:/bin/sh'\n"
+	if err := os.WriteFile(filepath.Join(bin, "getent"), []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write fake getent: %s", err)
+	}
+	patchEnv(t, "PATH", bin)
+
+	if dir, err := getentHome(); err != nil || dir != "/malicious" {
+		t.Fatalf("expected the getent in $PATH to be used by default, got %q (err: %v)", dir, err)
+	}
+
+	// without a trusted getent, the passwd file is parsed directly
+	fixture := filepath.Join(t.TempDir(), "passwd")
+	line := fmt.Sprintf("me:x:%d:%d::/home/trusted:/bin/sh\n", os.Geteuid(), os.Getegid())
+	if err := os.WriteFile(fixture, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	SetPasswdPath(fixture)
+
+	SetIgnoreEnv(true)
+	dir, err := getentHome()
+	if err != nil {
+		t.Fatalf("getentHome() failed: %s", err)
+	}
+	if dir == "/malicious" {
+		t.Error("expected the getent in $PATH to be ignored")
+	}
+	if _, statErr := os.Stat(trustedGetent); statErr != nil && dir != "/home/trusted" {
+		t.Errorf("expected %q from the passwd file, got %q", "/home/trusted", dir)
+	}
+}
+
+func TestSetLognameFallback(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1001", home: "/home/alice"}, passwdEntry{name: "bob", uid: "1002", home: "/home/bob"})
+
+	// neither HOME nor the passwd entry of the current user are available
+	original := currentUserHome
+	t.Cleanup(func() { currentUserHome = original })
+	currentUserHome = func() (string, error) { return "", nil }
+	patchEnv(t, "HOME", "")
+
+	tests := []struct {
+		name     string
+		enable   bool
+		logname  string
+		user     string
+		expected string
+	}{
+		{
+			name:     "LOGNAME",
+			enable:   true,
+			logname:  "alice",
+			user:     "bob",
+			expected: "/home/alice",
+		},
+		{
+			name:     "USER without LOGNAME",
+			enable:   true,
+			user:     "bob",
+			expected: "/home/bob",
+		},
+		{
+			name:    "unknown user",
+			enable:  true,
+			logname: "mallory",
+		},
+		{
+			name:    "fallback disabled",
+			enable:  false,
+			logname: "alice",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetLognameFallback(tc.enable)
+			patchEnv(t, "LOGNAME", tc.logname)
+			patchEnv(t, "USER", tc.user)
+
+			// the shell is the last resort, so only look at the strategies before it
+			list := fallbackStrategies("linux")
+			list = list[:len(list)-1]
+
+			dir, src, err := runStrategies("linux", list)
+			if tc.expected == "" {
+				if err == nil {
+					t.Errorf("expected error but got %q from %s", dir, src)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if dir != tc.expected || src != SourceLogname {
+				t.Errorf("expected %q from %s, got %q from %s", tc.expected, SourceLogname, dir, src)
+			}
+		})
+	}
+
+	t.Run("getent does not know the uid", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("the fake getent is a shell script")
+		}
+		currentUserHome = getentHome
+
+		// getent exits with 2 for unknown keys, as is common for arbitrary uids in containers
+		bin := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bin, "getent"), []byte("#!/bin/sh\nexit 2\n"), 0o755); err != nil {
+			t.Fatalf("failed to write fake getent: %s", err)
+		}
+		patchEnv(t, "PATH", bin)
+		SetLognameFallback(true)
+		patchEnv(t, "LOGNAME", "alice")
+
+		if dir, err := getentHome(); err != nil || dir != "" {
+			t.Errorf("expected no home without an error, got %q (err: %v)", dir, err)
+		}
+		list := fallbackStrategies("linux")
+		if dir, src, err := runStrategies("linux", list[:len(list)-1]); err != nil || dir != "/home/alice" || src != SourceLogname {
+			t.Errorf("expected %q from %s, got %q from %s (err: %v)", "/home/alice", SourceLogname, dir, src, err)
+		}
+	})
+}
+
+func TestSameHome(t *testing.T) {
+	tests := []struct {
+		name     string
+		goos     string
+		envA     map[string]string
+		envB     map[string]string
+		expected bool
+		err      bool
+	}{
+		{
+			name:     "windows HOME and HOMEDRIVE+HOMEPATH",
+			goos:     "windows",
+			envA:     map[string]string{"HOME": `C:\Users\me`},
+			envB:     map[string]string{"HOMEDRIVE": "C:", "HOMEPATH": `\Users\me`},
+			expected: true,
+		},
+		{
+			name:     "windows paths differing in case",
+			goos:     "windows",
+			envA:     map[string]string{"USERPROFILE": `C:\Users\me`},
+			envB:     map[string]string{"USERPROFILE": `c:\users\ME`},
+			expected: true,
+		},
+		{
+			name:     "windows USERPROFILE takes precedence",
+			goos:     "windows",
+			envA:     map[string]string{"USERPROFILE": `C:\Users\me`, "HOME": `D:\home`},
+			envB:     map[string]string{"HOME": `D:\home`},
+			expected: false,
+		},
+		{
+			name: "windows without any variable",
+			goos: "windows",
+			envA: map[string]string{"HOME": `C:\Users\me`},
+			envB: map[string]string{"HOMEDRIVE": "C:"},
+			err:  true,
+		},
+		{
+			name:     "trailing separator",
+			goos:     "linux",
+			envA:     map[string]string{"HOME": "/home/me/"},
+			envB:     map[string]string{"HOME": "/home/me", "USERPROFILE": "/elsewhere"},
+			expected: true,
+		},
+		{
+			name:     "different homes",
+			goos:     "linux",
+			envA:     map[string]string{"HOME": "/home/me"},
+			envB:     map[string]string{"HOME": "/home/other"},
+			expected: false,
+		},
+		{
+			name:     "plan9 lowercase variable",
+			goos:     "plan9",
+			envA:     map[string]string{"home": "/usr/me"},
+			envB:     map[string]string{"home": "/usr/me", "HOME": "/usr/other"},
+			expected: true,
+		},
+		{
+			name: "unset HOME",
+			goos: "linux",
+			envA: map[string]string{"HOME": "/home/me"},
+			envB: map[string]string{},
+			err:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := SameHome(tc.envA, tc.envB, tc.goos)
+			if (err != nil) != tc.err {
+				t.Fatalf("SameHome() error: got %v, want error: %v", err, tc.err)
+			}
+			if actual != tc.expected {
+				t.Errorf("SameHome() = %v, want %v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSetPrimaryEnvVar(t *testing.T) {
+	restoreCache(t)
+	ClearHomeDir()
+	SetRespectSSHUser(false)
+
+	patchEnv(t, "HOME", "/env/home")
+	patchEnv(t, "USERPROFILE", "/env/home")
+	patchEnv(t, "MY_HOME", "/primary/home")
+
+	SetPrimaryEnvVar("MY_HOME")
+
+	dir, src, err := Detect()
+	if err != nil {
+		t.Fatalf("Detect() failed: %s", err)
+	}
+	if dir != "/primary/home" || src != SourcePrimaryEnv {
+		t.Errorf("expected %q from %v, got %q from %v", "/primary/home", SourcePrimaryEnv, dir, src)
+	}
+	if dir, err := Dir(); err != nil || dir != "/primary/home" {
+		t.Errorf("expected Dir() to return %q, got %q (err: %v)", "/primary/home", dir, err)
+	}
+	if names := ConsultedEnvVars(); len(names) == 0 || names[0] != "MY_HOME" {
+		t.Errorf("expected MY_HOME to be consulted first, got %v", names)
+	}
+
+	// an empty primary variable falls through to the platform defaults
+	patchEnv(t, "MY_HOME", "")
+	if _, src, err := Detect(); err != nil || src == SourcePrimaryEnv {
+		t.Errorf("expected detection to fall through, got %v (err: %v)", src, err)
+	}
+
+	// an empty name disables it
+	patchEnv(t, "MY_HOME", "/primary/home")
+	SetPrimaryEnvVar("")
+	if _, src, err := Detect(); err != nil || src == SourcePrimaryEnv {
+		t.Errorf("expected primary variable to be disabled, got %v (err: %v)", src, err)
+	}
+}
+
+func TestConsultedEnvVars(t *testing.T) {
+	tests := []struct {
+		goos     string
+		expected []string
+	}{
+		{"windows", []string{"USERPROFILE", "HOME", "HOMEDRIVE", "HOMEPATH"}},
+		{"plan9", []string{"home"}},
+		{"linux", []string{"HOME"}},
+		{"darwin", []string{"HOME"}},
+		{"freebsd", []string{"HOME"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.goos, func(t *testing.T) {
+			actual := consultedEnvVars(tc.goos)
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+
+	if actual, expected := ConsultedEnvVars(), consultedEnvVars(runtime.GOOS); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v for %s, got %v", expected, runtime.GOOS, actual)
+	}
+
+	if runtime.GOOS != "windows" {
+		SetLognameFallback(true)
+		t.Cleanup(func() {
+			SetLognameFallback(false)
+		})
+		expected := append(consultedEnvVars(runtime.GOOS), "LOGNAME", "USER")
+		if actual := ConsultedEnvVars(); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %v with the logname fallback, got %v", expected, actual)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	restoreCache(t)
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatalf("failed to get current user: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "non-tilde path",
+			input:  "/foo",
+			output: "/foo",
+			err:    false,
+		},
+		{
+			name:   "tilde with path",
+			input:  "~/foo",
+			output: filepath.Join(u.HomeDir, "foo"),
+			err:    false,
+		},
+		{
+			name:   "empty path",
+			input:  "",
+			output: "",
+			err:    false,
+		},
+		{
+			name:   "tilde only",
+			input:  "~",
+			output: u.HomeDir,
+			err:    false,
+		},
+		{
+			name:   "tilde with user",
+			input:  "~user/foo",
+			output: "",
+			err:    true,
+		},
+	}
+
+	funcs := []struct {
+		name   string
+		expand func(string) (string, error)
+	}{
+		{"Expand", Expand},
+		{"Resolve", Resolve},
+	}
+
+	for _, fn := range funcs {
+		for _, tc := range tests {
+			t.Run(fn.name+"/"+tc.name, func(t *testing.T) {
+				actual, err := fn.expand(tc.input)
+				if (err != nil) != tc.err {
+					t.Fatalf("%s(%q) error: got %v, want error: %v", fn.name, tc.input, err, tc.err)
+				}
+
+				if actual != tc.output {
+					t.Errorf("%s(%q) = %q, want %q", fn.name, tc.input, actual, tc.output)
+				}
+			})
+		}
+	}
+
+	// test with cache disabled and custom home
+	t.Run("custom home with disabled cache", func(t *testing.T) {
+		SetCacheEnable(false)
+		homeEnv := "HOME"
+		if runtime.GOOS == "windows" {
+			homeEnv = "USERPROFILE" // more likely to work on Windows
+		}
+
+		patchEnv(t, homeEnv, "/custom/path")
+
+		// reset cache to ensure we pick up the new home
+		Reset()
+
+		expected := filepath.Join("/custom/path", "foo/bar")
+		actual, err := Expand("~/foo/bar")
+
+		if err != nil {
+			t.Errorf("no error expected, got: %v", err)
+		} else if actual != expected {
+			t.Errorf("expected: %v; actual: %v", expected, actual)
+		}
+	})
+}
+
+func TestExpandTildeMatchesDir(t *testing.T) {
+	restoreCache(t)
+
+	// Expand("~") must always be exactly Dir(), whatever the cache and env state
+	homeEnv := ConsultedEnvVars()[0]
+
+	tests := []struct {
+		name     string
+		cache    bool
+		home     string
+		override string
+	}{
+		{name: "cache enabled", cache: true, home: "/home/a"},
+		{name: "cache disabled", cache: false, home: "/home/a"},
+		{name: "cache enabled with unclean home", cache: true, home: "/home//b/"},
+		{name: "cache disabled with unclean home", cache: false, home: "/home//b/"},
+		{name: "override", cache: true, home: "/home/a", override: "/override/"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetCacheEnable(tc.cache)
+			SetHomeDir(tc.override)
+			patchEnv(t, homeEnv, tc.home)
+			Reset()
+
+			for i := 0; i < 2; i++ {
+				dir, err := Dir()
+				if err != nil {
+					t.Fatalf("Dir() failed: %s", err)
+				}
+				expanded, err := Expand("~")
+				if err != nil {
+					t.Fatalf("Expand() failed: %s", err)
+				}
+				if expanded != dir {
+					t.Errorf("Expand(%q) = %q, want Dir() = %q", "~", expanded, dir)
+				}
+
+				// change the env between iterations, which only has an effect with the cache disabled
+				patchEnv(t, homeEnv, tc.home+"changed")
+			}
+		})
+	}
+
+	// anything after the tilde gives a cleaned path, even if it is dropped
+	SetHomeDir("/home/me/")
+	for _, input := range []string{"~/", "~//", "~/."} {
+		if actual, err := Expand(input); err != nil || actual != filepath.Clean("/home/me") {
+			t.Errorf("Expand(%q) = %q, want %q (err: %v)", input, actual, filepath.Clean("/home/me"), err)
+		}
+	}
+}
+
+func TestExpandCache(t *testing.T) {
+	restoreCache(t)
+
+	SetCacheEnable(true)
+	Reset()
+
+	expected, err := Expand("~/foo")
+	if err != nil {
+		t.Fatalf("Expand() failed: %s", err)
+	}
+
+	cached := expandCache.Load().(expandCacheEntry)
+	if cached.input != "~/foo" || cached.output != expected {
+		t.Errorf("expected cached entry for %q -> %q, got %+v", "~/foo", expected, cached)
+	}
+
+	// a different input replaces the single entry
+	if _, err := Expand("~/bar"); err != nil {
+		t.Fatalf("Expand() failed: %s", err)
+	}
+	if cached := expandCache.Load().(expandCacheEntry); cached.input != "~/bar" {
+		t.Errorf("expected cached entry for %q, got %+v", "~/bar", cached)
+	}
+
+	// reset invalidates the entry
+	Reset()
+	if cached := expandCache.Load().(expandCacheEntry); cached != (expandCacheEntry{}) {
+		t.Errorf("expected empty cache entry after Reset(), got %+v", cached)
+	}
+
+	// disabling the cache invalidates the entry and stops populating it
+	if _, err := Expand("~/foo"); err != nil {
+		t.Fatalf("Expand() failed: %s", err)
+	}
+	SetCacheEnable(false)
+	if cached := expandCache.Load().(expandCacheEntry); cached != (expandCacheEntry{}) {
+		t.Errorf("expected empty cache entry after disabling cache, got %+v", cached)
+	}
+
+	homeEnv := "HOME"
+	if runtime.GOOS == "plan9" {
+		homeEnv = "home"
+	} else if runtime.GOOS == "windows" {
+		homeEnv = "USERPROFILE"
+	}
+	patchEnv(t, homeEnv, "/custom/path")
+
+	actual, err := Expand("~/foo")
+	if err != nil {
+		t.Fatalf("Expand() failed: %s", err)
+	}
+	if want := filepath.Join("/custom/path", "foo"); actual != want {
+		t.Errorf("expected %q, got %q", want, actual)
+	}
+	if cached := expandCache.Load().(expandCacheEntry); cached != (expandCacheEntry{}) {
+		t.Errorf("expected no cache entry while caching is disabled, got %+v", cached)
+	}
+}
+
+func TestExpandRich(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1000", home: "/home/alice"})
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected ExpandResult
+		err      bool
+	}{
+		{
+			name:  "tilde with path",
+			input: "~/foo",
+			expected: ExpandResult{
+				Path:  filepath.Join(home, "foo"),
+				Tilde: true,
+				Home:  home,
+			},
+		},
+		{
+			name:  "tilde with known user",
+			input: "~alice/foo",
+			expected: ExpandResult{
+				Path:  filepath.Join("/home/alice", "foo"),
+				Tilde: true,
+				User:  "alice",
+				Home:  "/home/alice",
+			},
+		},
+		{
+			name:  "known user only",
+			input: "~alice",
+			expected: ExpandResult{
+				Path:  "/home/alice",
+				Tilde: true,
+				User:  "alice",
+				Home:  "/home/alice",
+			},
+		},
+		{
+			name:  "non-tilde path",
+			input: "/foo",
+			expected: ExpandResult{
+				Path: "/foo",
+			},
+		},
+		{
+			name:  "tilde with unknown user",
+			input: "~user/foo",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandRich(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("ExpandRich(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if actual != tc.expected {
+				t.Errorf("ExpandRich(%q) = %+v, want %+v", tc.input, actual, tc.expected)
+			}
+
+			// Expand is a thin wrapper around ExpandRich
+			expanded, err := Expand(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("Expand(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if expanded != tc.expected.Path {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, expanded, tc.expected.Path)
+			}
+		})
+	}
+}
+
+func TestSetExpandPostProcessor(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(true)
+	SetHomeDir("/home/me")
+
+	var received []string
+	SetExpandPostProcessor(func(path string) string {
+		received = append(received, path)
+		return "/sandbox" + path
+	})
+
+	tests := []struct {
+		name     string
+		input    string
+		received string
+		output   string
+	}{
+		{
+			name:     "runs after cleaning",
+			input:    "~//a/../b",
+			received: filepath.Join("/home/me", "b"),
+			output:   "/sandbox" + filepath.Join("/home/me", "b"),
+		},
+		{
+			name:     "cached result",
+			input:    "~//a/../b",
+			received: filepath.Join("/home/me", "b"),
+			output:   "/sandbox" + filepath.Join("/home/me", "b"),
+		},
+		{
+			name:     "non-tilde path",
+			input:    "/abs",
+			received: "/abs",
+			output:   "/sandbox/abs",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			received = nil
+			actual, err := Expand(tc.input)
+			if err != nil {
+				t.Fatalf("Expand(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+			if len(received) != 1 || received[0] != tc.received {
+				t.Errorf("expected the processor to receive %q once, got %q", tc.received, received)
+			}
+		})
+	}
+
+	// the length limit applies to the processed result
+	SetMaxPathLength(len(filepath.Join("/home/me", "b")) + 1)
+	if actual, err := Expand("~/b"); err == nil {
+		t.Errorf("Expand(%q) = %q, want error for the processed result exceeding the limit", "~/b", actual)
+	}
+	SetMaxPathLength(0)
+
+	SetExpandPostProcessor(nil)
+	received = nil
+	if actual, err := Expand("~/b"); err != nil || actual != filepath.Join("/home/me", "b") {
+		t.Errorf("Expand(%q) = %q, want %q (err: %v)", "~/b", actual, filepath.Join("/home/me", "b"), err)
+	}
+	if len(received) != 0 {
+		t.Errorf("expected no processing after unsetting, got %q", received)
+	}
+}
+
+func TestSetMaxPathLength(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/x")
+
+	// "/home/x/abc" is 11 bytes long
+	tests := []struct {
+		name  string
+		limit int
+		input string
+		err   bool
+	}{
+		{
+			name:  "unlimited",
+			limit: 0,
+			input: "~/abc",
+		},
+		{
+			name:  "at the limit",
+			limit: 11,
+			input: "~/abc",
+		},
+		{
+			name:  "over the limit",
+			limit: 10,
+			input: "~/abc",
+			err:   true,
+		},
+		{
+			name:  "non-tilde path over the limit",
+			limit: 10,
+			input: "/home/x/abc",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetMaxPathLength(tc.limit)
+
+			actual, err := Expand(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("Expand(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if tc.err {
+				if !strings.Contains(err.Error(), strconv.Itoa(tc.limit)) {
+					t.Errorf("expected error to mention the limit, got: %v", err)
+				}
+				return
+			}
+			if actual != filepath.Join("/home/x", "abc") {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, filepath.Join("/home/x", "abc"))
+			}
+		})
+	}
+}
+
+func TestExpandPlan(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	// backslashes are only separators on windows, elsewhere they belong to the file name
+	backslashRest := `\foo`
+	if runtime.GOOS == "windows" {
+		backslashRest = "foo"
+	}
+
+	tests := []struct {
+		name      string
+		input     string
+		home      string
+		rest      string
+		usesTilde bool
+		err       bool
+	}{
+		{
+			name:      "tilde with backslash",
+			input:     `~\foo`,
+			home:      home,
+			rest:      backslashRest,
+			usesTilde: true,
+		},
+		{
+			name:      "tilde with path",
+			input:     "~/a/b",
+			home:      home,
+			rest:      "a/b",
+			usesTilde: true,
+		},
+		{
+			name:      "tilde only",
+			input:     "~",
+			home:      home,
+			rest:      "",
+			usesTilde: true,
+		},
+		{
+			name:      "non-tilde path",
+			input:     "/foo/bar",
+			home:      "",
+			rest:      "/foo/bar",
+			usesTilde: false,
+		},
+		{
+			name:      "tilde with user",
+			input:     "~user/foo",
+			usesTilde: true,
+			err:       true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, rest, usesTilde, err := ExpandPlan(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("ExpandPlan(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+
+			if h != tc.home || rest != tc.rest || usesTilde != tc.usesTilde {
+				t.Errorf("ExpandPlan(%q) = (%q, %q, %v), want (%q, %q, %v)", tc.input, h, rest, usesTilde, tc.home, tc.rest, tc.usesTilde)
+			}
+
+			if tc.err || !usesTilde {
+				return
+			}
+
+			expanded, err := Expand(tc.input)
+			if err != nil {
+				t.Fatalf("Expand(%q) failed: %s", tc.input, err)
+			}
+			if joined := filepath.Join(h, rest); joined != expanded {
+				t.Errorf("joined plan %q does not match Expand(%q) = %q", joined, tc.input, expanded)
+			}
+		})
+	}
+}
+
+func TestExpandClean(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		expand string
+		clean  string
+	}{
+		{
+			name:   "non-tilde path with parent reference",
+			input:  "/abs/../x",
+			expand: "/abs/../x",
+			clean:  filepath.Clean("/abs/../x"),
+		},
+		{
+			name:   "tilde path with parent reference",
+			input:  "~/a/../b",
+			expand: filepath.Join(home, "b"),
+			clean:  filepath.Join(home, "b"),
+		},
+		{
+			name:   "tilde path with duplicate separators",
+			input:  "~//a//b",
+			expand: filepath.Join(home, "a", "b"),
+			clean:  filepath.Join(home, "a", "b"),
+		},
+		{
+			name:   "non-tilde path with duplicate separators",
+			input:  "/x//y",
+			expand: "/x//y",
+			clean:  filepath.Clean("/x//y"),
+		},
+		{
+			name:   "empty path",
+			input:  "",
+			expand: "",
+			clean:  "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			expanded, err := Expand(tc.input)
+			if err != nil {
+				t.Fatalf("Expand(%q) failed: %s", tc.input, err)
+			}
+			if expanded != tc.expand {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, expanded, tc.expand)
+			}
+
+			cleaned, err := ExpandClean(tc.input)
+			if err != nil {
+				t.Fatalf("ExpandClean(%q) failed: %s", tc.input, err)
+			}
+			if cleaned != tc.clean {
+				t.Errorf("ExpandClean(%q) = %q, want %q", tc.input, cleaned, tc.clean)
+			}
+		})
+	}
+
+	if _, err := ExpandClean("~user/foo"); err == nil {
+		t.Error("expected error for user-specific path but got none")
+	}
+}
+
+func TestCleanExpand(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1001", home: "/home/alice"})
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "benign parent reference",
+			input:  "~/a/../b",
+			output: filepath.Join("/home/me", "b"),
+		},
+		{
+			name:   "parent reference back to home",
+			input:  "~/a/..",
+			output: filepath.Clean("/home/me"),
+		},
+		{
+			name:  "escaping parent reference",
+			input: "~/../../etc",
+			err:   true,
+		},
+		{
+			name:  "escaping to a sibling home",
+			input: "~/../other",
+			err:   true,
+		},
+		{
+			name:   "user path within its home",
+			input:  "~alice/x/../y",
+			output: filepath.Join("/home/alice", "y"),
+		},
+		{
+			name:  "user path escaping its home",
+			input: "~alice/../me",
+			err:   true,
+		},
+		{
+			name:   "non-tilde path is only cleaned",
+			input:  "/a/../../etc",
+			output: filepath.Clean("/etc"),
+		},
+		{
+			name:   "empty path",
+			input:  "",
+			output: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := CleanExpand(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Errorf("CleanExpand(%q) = %q, want error", tc.input, actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CleanExpand(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("CleanExpand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	t.Run("containment is checked before post-processing", func(t *testing.T) {
+		SetExpandPostProcessor(func(path string) string {
+			return "/sandbox" + path
+		})
+		t.Cleanup(func() {
+			SetExpandPostProcessor(nil)
+		})
+		if actual, err := CleanExpand("~/a/../b"); err != nil || actual != "/sandbox"+filepath.Join("/home/me", "b") {
+			t.Errorf("CleanExpand(%q) = %q, want the processed path (err: %v)", "~/a/../b", actual, err)
+		}
+		if actual, err := CleanExpand("~/../other"); err == nil {
+			t.Errorf("CleanExpand(%q) = %q, want error", "~/../other", actual)
+		}
+	})
+}
+
+func TestExpandAbs(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %s", err)
+	}
+
+	absolute := filepath.Join(wd, "abs")
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{
+			name:   "current directory",
+			input:  ".",
+			output: wd,
+		},
+		{
+			name:   "relative path",
+			input:  "./x",
+			output: filepath.Join(wd, "x"),
+		},
+		{
+			name:   "tilde path",
+			input:  "~/x",
+			output: filepath.Join(home, "x"),
+		},
+		{
+			name:   "absolute path",
+			input:  absolute,
+			output: absolute,
+		},
+		{
+			name:   "empty path",
+			input:  "",
+			output: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandAbs(tc.input)
+			if err != nil {
+				t.Fatalf("ExpandAbs(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandAbs(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	// Expand keeps relative paths relative
+	if actual, err := Expand("./x"); err != nil || actual != "./x" {
+		t.Errorf("Expand(%q) = %q, %v; want %q", "./x", actual, err, "./x")
+	}
+}
+
+func TestExpandSplit(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir(filepath.Join(string(filepath.Separator)+"home", "me"))
+	stubLookupUser(t)
+	sep := string(filepath.Separator)
+
+	tests := []struct {
+		name  string
+		input string
+		dir   string
+		file  string
+		err   bool
+	}{
+		{
+			name:  "nested path",
+			input: "~/a/b",
+			dir:   filepath.Join(sep+"home", "me", "a") + sep,
+			file:  "b",
+		},
+		{
+			name:  "trailing separator",
+			input: "~/a/",
+			dir:   filepath.Join(sep+"home", "me") + sep,
+			file:  "a",
+		},
+		{
+			name:  "bare tilde",
+			input: "~",
+			dir:   sep + "home" + sep,
+			file:  "me",
+		},
+		{
+			name:  "non-tilde path",
+			input: "x/y",
+			dir:   "x/",
+			file:  "y",
+		},
+		{
+			name:  "unknown user",
+			input: "~mallory/x",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, file, err := ExpandSplit(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Errorf("ExpandSplit(%q) = %q, %q, want error", tc.input, dir, file)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExpandSplit(%q) failed: %s", tc.input, err)
+			}
+			if dir != tc.dir || file != tc.file {
+				t.Errorf("ExpandSplit(%q) = %q, %q, want %q, %q", tc.input, dir, file, tc.dir, tc.file)
+			}
+		})
+	}
+}
+
+func TestExpandWritable(t *testing.T) {
+	restoreCache(t)
+
+	home := t.TempDir()
+	SetHomeDir(home)
+
+	if err := os.WriteFile(filepath.Join(home, "file"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "file in home",
+			input:  "~/config",
+			output: filepath.Join(home, "config"),
+		},
+		{
+			name:  "missing parent",
+			input: "~/missing/config",
+			err:   true,
+		},
+		{
+			name:  "parent is a file",
+			input: "~/file/config",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandWritable(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Errorf("ExpandWritable(%q) = %q, want error", tc.input, actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExpandWritable(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandWritable(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	// the write check leaves nothing behind
+	entries, err := os.ReadDir(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only %q in home, got %d entries", "file", len(entries))
+	}
+
+	t.Run("read-only directory", func(t *testing.T) {
 		if runtime.GOOS == "windows" {
-			homeEnv = "USERPROFILE" // more likely to work on Windows
+			t.Skip("directory permissions are not enforced on windows")
+		}
+		if os.Geteuid() == 0 {
+			t.Skip("root can write to read-only directories")
+		}
+		readOnly := filepath.Join(home, "read-only")
+		if err := os.Mkdir(readOnly, 0o555); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = os.Chmod(readOnly, 0o755) })
+
+		if _, err := ExpandWritable("~/read-only/config"); err == nil {
+			t.Error("expected an error for a read-only directory")
+		}
+	})
+}
+
+func TestSetExpandAfterEquals(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+
+	tests := []struct {
+		name    string
+		enabled bool
+		input   string
+		output  string
+	}{
+		{
+			name:    "assignment",
+			enabled: true,
+			input:   "KEY=~/x",
+			output:  "KEY=" + filepath.Join("/home/me", "x"),
+		},
+		{
+			name:    "leading tilde",
+			enabled: true,
+			input:   "~/x",
+			output:  filepath.Join("/home/me", "x"),
+		},
+		{
+			name:    "tilde not directly after equals",
+			enabled: true,
+			input:   "KEY= ~/x",
+			output:  "KEY= ~/x",
+		},
+		{
+			name:    "only the first equals",
+			enabled: true,
+			input:   "KEY=a=~/x",
+			output:  "KEY=a=~/x",
+		},
+		{
+			name:    "bare tilde",
+			enabled: true,
+			input:   "KEY=~",
+			output:  "KEY=~",
+		},
+		{
+			name:   "disabled",
+			input:  "KEY=~/x",
+			output: "KEY=~/x",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetExpandAfterEquals(tc.enabled)
+
+			actual, err := Expand(tc.input)
+			if err != nil {
+				t.Fatalf("Expand(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+}
+
+func TestSetForceAbsoluteHome(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir(filepath.Join("relative", "home"))
+
+	t.Run("error by default", func(t *testing.T) {
+		SetForceAbsoluteHome(false)
+		if actual, err := Expand("~/x"); err == nil {
+			t.Errorf("expected error for relative home, got %q", actual)
+		}
+		// paths without a tilde are not affected
+		if actual, err := Expand(filepath.Join("relative", "x")); err != nil || actual != filepath.Join("relative", "x") {
+			t.Errorf("expected non-tilde path as-is, got %q (err: %v)", actual, err)
+		}
+	})
+
+	t.Run("force absolute", func(t *testing.T) {
+		SetForceAbsoluteHome(true)
+		expected, err := filepath.Abs(filepath.Join("relative", "home", "x"))
+		if err != nil {
+			t.Fatalf("Abs() failed: %s", err)
+		}
+
+		actual, err := Expand("~/x")
+		if err != nil {
+			t.Fatalf("Expand() failed: %s", err)
+		}
+		if actual != expected {
+			t.Errorf("expected %q, got %q", expected, actual)
+		}
+
+		// Dir still reports the home as detected
+		if dir, err := Dir(); err != nil || dir != filepath.Join("relative", "home") {
+			t.Errorf("Dir() = %q, want %q (err: %v)", dir, filepath.Join("relative", "home"), err)
+		}
+	})
+
+	t.Run("variants", func(t *testing.T) {
+		SetForceAbsoluteHome(false)
+		if _, _, _, err := ExpandPlan("~/x"); err == nil {
+			t.Error("expected ExpandPlan to reject a relative home")
+		}
+		if _, err := ExpandUnderRoot("~/x", "/mnt"); err == nil {
+			t.Error("expected ExpandUnderRoot to reject a relative home")
+		}
+		if _, err := ExpandAsHome("~/x", "relative"); err == nil {
+			t.Error("expected ExpandAsHome to reject a relative home")
+		}
+		resolve := func(string) (string, error) { return "relative", nil }
+		if _, err := ExpandFunc("~alice/x", resolve); err == nil {
+			t.Error("expected ExpandFunc to reject a relative home")
+		}
+
+		SetForceAbsoluteHome(true)
+		home, _, _, err := ExpandPlan("~/x")
+		if err != nil || !filepath.IsAbs(home) {
+			t.Errorf("ExpandPlan() home = %q, want an absolute path (err: %v)", home, err)
+		}
+		if actual, err := ExpandAsHome("~/x", "relative"); err != nil || !filepath.IsAbs(actual) {
+			t.Errorf("ExpandAsHome() = %q, want an absolute path (err: %v)", actual, err)
+		}
+	})
+}
+
+func TestSetWindowsNormalizeDriveRoot(t *testing.T) {
+	restoreCache(t)
+
+	tests := []struct {
+		name      string
+		goos      string
+		home      string
+		normalize bool
+		expected  string
+		err       bool
+	}{
+		{
+			name: "drive-only home is rejected",
+			goos: "windows",
+			home: "C:",
+			err:  true,
+		},
+		{
+			name:      "drive-only home is normalized",
+			goos:      "windows",
+			home:      "C:",
+			normalize: true,
+			expected:  `C:\`,
+		},
+		{
+			name:      "lowercase drive letter",
+			goos:      "windows",
+			home:      "d:",
+			normalize: true,
+			expected:  `d:\`,
+		},
+		{
+			name:     "drive root is left as-is",
+			goos:     "windows",
+			home:     `C:\`,
+			expected: `C:\`,
+		},
+		{
+			name:     "home with path is left as-is",
+			goos:     "windows",
+			home:     `C:\Users\me`,
+			expected: `C:\Users\me`,
+		},
+		{
+			name:     "drive letters are not special on other systems",
+			goos:     "linux",
+			home:     "C:",
+			expected: "C:",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetWindowsNormalizeDriveRoot(tc.normalize)
+
+			actual, err := checkDriveRoot(tc.goos, tc.home)
+			if tc.err {
+				if err == nil {
+					t.Errorf("checkDriveRoot(%q, %q) = %q, want error", tc.goos, tc.home, actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkDriveRoot(%q, %q) failed: %s", tc.goos, tc.home, err)
+			}
+			if actual != tc.expected {
+				t.Errorf("checkDriveRoot(%q, %q) = %q, want %q", tc.goos, tc.home, actual, tc.expected)
+			}
+		})
+	}
+
+	t.Run("expand", func(t *testing.T) {
+		if runtime.GOOS != "windows" {
+			t.Skip("drive letters are only special on windows")
+		}
+		SetHomeDir("C:")
+
+		SetWindowsNormalizeDriveRoot(false)
+		if actual, err := Expand("~/x"); err == nil {
+			t.Errorf("Expand(%q) = %q, want error", "~/x", actual)
+		}
+
+		SetWindowsNormalizeDriveRoot(true)
+		if actual, err := Expand("~/x"); err != nil || actual != `C:\x` {
+			t.Errorf("Expand(%q) = %q, want %q (err: %v)", "~/x", actual, `C:\x`, err)
+		}
+	})
+}
+
+func TestExpandFS(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t)
+
+	home := t.TempDir()
+	SetHomeDir(home)
+
+	for _, name := range []string{"a.txt", "b.txt", filepath.Join("nested", "c.txt")} {
+		path := filepath.Join(home, "sub", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatalf("failed to create file: %s", err)
+		}
+	}
+
+	fsys, err := ExpandFS("~/sub")
+	if err != nil {
+		t.Fatalf("ExpandFS() failed: %s", err)
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatalf("ReadDir() failed: %s", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if expected := []string{"a.txt", "b.txt", "nested"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected entries %v, got %v", expected, names)
+	}
+
+	for _, input := range []string{"~mallory/sub", "~/missing", "~/sub/a.txt"} {
+		if _, err := ExpandFS(input); err == nil {
+			t.Errorf("ExpandFS(%q): expected error", input)
+		}
+	}
+}
+
+func TestExpandAsHome(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/detected/home")
+
+	home := filepath.Join(string(filepath.Separator)+"other", "home")
+
+	tests := []struct {
+		name   string
+		input  string
+		home   string
+		output string
+		err    bool
+	}{
+		{
+			name:   "tilde",
+			input:  "~",
+			home:   home,
+			output: home,
+		},
+		{
+			name:   "tilde with path",
+			input:  "~/foo/bar",
+			home:   home,
+			output: filepath.Join(home, "foo", "bar"),
+		},
+		{
+			name:   "no tilde",
+			input:  "foo/bar",
+			home:   home,
+			output: "foo/bar",
+		},
+		{
+			name:  "user-specific tilde",
+			input: "~alice/foo",
+			home:  home,
+			err:   true,
+		},
+		{
+			name:  "empty home",
+			input: "~/foo",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandAsHome(tc.input, tc.home)
+			if (err != nil) != tc.err {
+				t.Fatalf("ExpandAsHome(%q, %q) error: got %v, want error: %v", tc.input, tc.home, err, tc.err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandAsHome(%q, %q) = %q, want %q", tc.input, tc.home, actual, tc.output)
+			}
+		})
+	}
+
+	SetExpandPostProcessor(strings.ToUpper)
+	t.Cleanup(func() {
+		SetExpandPostProcessor(nil)
+	})
+	if actual, err := ExpandAsHome("~/x", home); err != nil || actual != strings.ToUpper(filepath.Join(home, "x")) {
+		t.Errorf("ExpandAsHome(%q, %q) = %q, want the processed path (err: %v)", "~/x", home, actual, err)
+	}
+}
+
+func TestExpandUnderRoot(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1000", home: "/home/alice"})
+
+	root := filepath.Join(t.TempDir(), "mnt", "target")
+	home := filepath.Join(string(filepath.Separator)+"home", "me")
+	SetHomeDir(home)
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{
+			name:   "tilde",
+			input:  "~",
+			output: filepath.Join(root, "home", "me"),
+		},
+		{
+			name:   "tilde with path",
+			input:  "~/.bashrc",
+			output: filepath.Join(root, "home", "me", ".bashrc"),
+		},
+		{
+			name:   "user-specific tilde",
+			input:  "~alice/.profile",
+			output: filepath.Join(root, "home", "alice", ".profile"),
+		},
+		{
+			name:   "no tilde",
+			input:  "/etc/passwd",
+			output: "/etc/passwd",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandUnderRoot(tc.input, root)
+			if err != nil {
+				t.Fatalf("ExpandUnderRoot(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandUnderRoot(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	t.Run("relative home", func(t *testing.T) {
+		SetHomeDir("relative/home")
+		if _, err := ExpandUnderRoot("~/.bashrc", root); err == nil {
+			t.Error("expected error for relative home directory")
+		}
+	})
+}
+
+func TestExpandFunc(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+
+	homes := map[string]string{
+		"alice": "/db/alice",
+		"bob":   "/db/bob",
+	}
+	errNoSuchUser := errors.New("no such user")
+	resolve := func(user string) (string, error) {
+		if home, ok := homes[user]; ok {
+			return home, nil
+		}
+		return "", errNoSuchUser
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "current user",
+			input:  "~/x",
+			output: filepath.Join("/home/me", "x"),
+		},
+		{
+			name:   "resolved user",
+			input:  "~alice/x",
+			output: filepath.Join("/db/alice", "x"),
+		},
+		{
+			name:   "resolved user without path",
+			input:  "~bob",
+			output: "/db/bob",
+		},
+		{
+			name:  "unresolved user",
+			input: "~mallory/x",
+			err:   true,
+		},
+		{
+			name:   "no tilde",
+			input:  "/x",
+			output: "/x",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandFunc(tc.input, resolve)
+			if (err != nil) != tc.err {
+				t.Fatalf("ExpandFunc(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if tc.err && !errors.Is(err, errNoSuchUser) {
+				t.Errorf("expected error wrapping %v, got %v", errNoSuchUser, err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandFunc(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	// the settings of Expand apply as well
+	SetExpandPostProcessor(strings.ToUpper)
+	if actual, err := ExpandFunc("~alice/x", resolve); err != nil || actual != strings.ToUpper(filepath.Join("/db/alice", "x")) {
+		t.Errorf("expected post-processed path, got %q (err: %v)", actual, err)
+	}
+	SetExpandPostProcessor(nil)
+
+	SetUnknownUserPolicy(UnknownUserPassthrough)
+	unknown := func(user string) (string, error) { return "", fmt.Errorf("%w %q", ErrUnknownUser, user) }
+	if actual, err := ExpandFunc("~mallory/x", unknown); err != nil || actual != "~mallory/x" {
+		t.Errorf("expected unknown user to be left unexpanded, got %q (err: %v)", actual, err)
+	}
+}
+
+func TestResolveHomeRelative(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	absolute, err := filepath.Abs(filepath.Join("abs", "path"))
+	if err != nil {
+		t.Fatalf("failed to make path absolute: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{
+			name:   "relative path",
+			input:  "go/bin",
+			output: filepath.Join(home, "go", "bin"),
+		},
+		{
+			name:   "tilde path",
+			input:  "~/go/bin",
+			output: filepath.Join(home, "go", "bin"),
+		},
+		{
+			name:   "absolute path",
+			input:  absolute,
+			output: absolute,
+		},
+		{
+			name:   "empty path",
+			input:  "",
+			output: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ResolveHomeRelative(tc.input)
+			if err != nil {
+				t.Fatalf("ResolveHomeRelative(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("ResolveHomeRelative(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	// relative paths are expanded like `~/` paths, post-processing included
+	SetExpandPostProcessor(strings.ToUpper)
+	t.Cleanup(func() {
+		SetExpandPostProcessor(nil)
+	})
+	if actual, err := ResolveHomeRelative("go/bin"); err != nil || actual != strings.ToUpper(filepath.Join(home, "go", "bin")) {
+		t.Errorf("ResolveHomeRelative(%q) = %q, want the processed path (err: %v)", "go/bin", actual, err)
+	}
+}
+
+func TestExpandAny(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "tilde",
+			input:  "~/foo",
+			output: filepath.Join(home, "foo"),
+		},
+		{
+			name:   "dollar home",
+			input:  "$HOME/foo",
+			output: filepath.Join(home, "foo"),
+		},
+		{
+			name:   "braced dollar home",
+			input:  "${HOME}/foo",
+			output: filepath.Join(home, "foo"),
+		},
+		{
+			name:   "percent userprofile",
+			input:  "%USERPROFILE%\\foo",
+			output: filepath.Join(home, "\\foo"),
+		},
+		{
+			name:   "token only",
+			input:  "$HOME",
+			output: home,
+		},
+		{
+			name:   "token prefix of another variable",
+			input:  "$HOMEDIR/foo",
+			output: "$HOMEDIR/foo",
+		},
+		{
+			name:   "token not leading",
+			input:  "/foo/$HOME",
+			output: "/foo/$HOME",
+		},
+		{
+			name:   "non-tilde path",
+			input:  "/foo",
+			output: "/foo",
+		},
+		{
+			name:  "tilde with user",
+			input: "~user/foo",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandAny(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("ExpandAny(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+
+			if actual != tc.output {
+				t.Errorf("ExpandAny(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+}
+
+func TestExpandEscaped(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "escaped tilde",
+			input:  `\~x`,
+			output: "~x",
+		},
+		{
+			name:   "escaped tilde with path",
+			input:  `\~/x`,
+			output: "~/x",
+		},
+		{
+			name:   "tilde with path",
+			input:  "~/x",
+			output: filepath.Join(home, "x"),
+		},
+		{
+			name:  "unescaped tilde with unknown user",
+			input: "~x",
+			err:   true,
+		},
+		{
+			name:   "escape not leading",
+			input:  `a/\~x`,
+			output: `a/\~x`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandEscaped(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("ExpandEscaped(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandEscaped(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	SetExpandPostProcessor(strings.ToUpper)
+	t.Cleanup(func() {
+		SetExpandPostProcessor(nil)
+	})
+	if actual, err := ExpandEscaped(`\~x`); err != nil || actual != "~X" {
+		t.Errorf("ExpandEscaped(%q) = %q, want the processed path (err: %v)", `\~x`, actual, err)
+	}
+}
+
+func TestExpandDoubleTilde(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "escaped tilde",
+			input:  "~~x",
+			output: "~x",
+		},
+		{
+			name:   "escaped tilde with path",
+			input:  "~~/x",
+			output: "~/x",
+		},
+		{
+			name:   "escaped tilde alone",
+			input:  "~~",
+			output: "~",
+		},
+		{
+			name:   "tilde with path",
+			input:  "~/x",
+			output: filepath.Join(home, "x"),
+		},
+		{
+			name:   "tilde alone",
+			input:  "~",
+			output: home,
+		},
+		{
+			name:   "escape not leading",
+			input:  "a/~~x",
+			output: "a/~~x",
+		},
+		{
+			name:   "backslash escape is not special",
+			input:  `\~x`,
+			output: `\~x`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandDoubleTilde(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("ExpandDoubleTilde(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandDoubleTilde(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+}
+
+func TestExpandQuoted(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{
+			name:   "double quoted",
+			input:  `"~/x"`,
+			output: filepath.Join(home, "x"),
+		},
+		{
+			name:   "single quoted",
+			input:  `'~/x'`,
+			output: filepath.Join(home, "x"),
+		},
+		{
+			name:   "unquoted",
+			input:  "~/x",
+			output: filepath.Join(home, "x"),
+		},
+		{
+			name:   "only one layer stripped",
+			input:  `"'~/x'"`,
+			output: `'~/x'`,
+		},
+		{
+			name:   "mismatched quotes",
+			input:  `"~/x'`,
+			output: `"~/x'`,
+		},
+		{
+			name:   "lone quote",
+			input:  `"`,
+			output: `"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandQuoted(tc.input)
+			if err != nil {
+				t.Fatalf("ExpandQuoted(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandQuoted(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+}
+
+func TestExpandPercent(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{
+			name:   "uppercase",
+			input:  "%7E/x",
+			output: filepath.Join("/home/me", "x"),
+		},
+		{
+			name:   "lowercase",
+			input:  "%7e/x",
+			output: filepath.Join("/home/me", "x"),
+		},
+		{
+			name:   "encoded tilde only",
+			input:  "%7E",
+			output: "/home/me",
+		},
+		{
+			name:   "rest is not decoded",
+			input:  "%7E/a%20b",
+			output: filepath.Join("/home/me", "a%20b"),
+		},
+		{
+			name:   "mid-string",
+			input:  "/x/%7E/y",
+			output: "/x/%7E/y",
+		},
+		{
+			name:   "plain tilde",
+			input:  "~/x",
+			output: filepath.Join("/home/me", "x"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandPercent(tc.input)
+			if err != nil {
+				t.Fatalf("ExpandPercent(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandPercent(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+}
+
+func TestExpandShell(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+	patchEnv(t, "HOME", "/env/home")
+	patchEnv(t, "HOMEDIR_EMPTY", "")
+	patchEnv(t, "HOMEDIR_UNSET", "")
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{
+			name:   "default with HOME set",
+			input:  "${HOME:-/tmp}/x",
+			output: "/env/home/x",
+		},
+		{
+			name:   "default with variable unset",
+			input:  "${HOMEDIR_UNSET:-/tmp}/x",
+			output: "/tmp/x",
+		},
+		{
+			name:   "default with variable empty",
+			input:  "${HOMEDIR_EMPTY:-/tmp}/x",
+			output: "/tmp/x",
+		},
+		{
+			name:   "assign default form",
+			input:  "${HOMEDIR_UNSET:=/var/tmp}/x",
+			output: "/var/tmp/x",
+		},
+		{
+			name:   "empty default",
+			input:  "/a${HOMEDIR_UNSET:-}/b",
+			output: "/a/b",
+		},
+		{
+			name:   "multiple expansions",
+			input:  "${HOME:-/tmp}:${HOMEDIR_UNSET:-/opt}",
+			output: "/env/home:/opt",
+		},
+		{
+			name:   "leading tilde",
+			input:  "~/${HOMEDIR_UNSET:-cache}",
+			output: filepath.Join("/home/me", "cache"),
+		},
+		{
+			name:   "substituted before cleaning",
+			input:  "~/a/${HOMEDIR_UNSET:-b/../c}",
+			output: filepath.Join("/home/me", "a", "c"),
+		},
+		{
+			name:   "duplicate separators in default",
+			input:  "~/${HOMEDIR_UNSET:-x//y}",
+			output: filepath.Join("/home/me", "x", "y"),
+		},
+		{
+			name:   "tilde in default is not expanded",
+			input:  "${HOMEDIR_UNSET:-~/x}",
+			output: "~/x",
+		},
+		{
+			name:   "unsupported forms",
+			input:  "$HOME/${HOME}/${HOME-x}/${1X:-y}",
+			output: "$HOME/${HOME}/${HOME-x}/${1X:-y}",
+		},
+		{
+			name:   "unsupported form followed by supported one",
+			input:  "${HOME}${HOMEDIR_UNSET:-/tmp}",
+			output: "${HOME}/tmp",
+		},
+		{
+			name:   "unterminated",
+			input:  "${HOME:-/tmp",
+			output: "${HOME:-/tmp",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandShell(tc.input)
+			if err != nil {
+				t.Fatalf("ExpandShell(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("ExpandShell(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	t.Run("processed after substitution", func(t *testing.T) {
+		var received []string
+		SetExpandPostProcessor(func(path string) string {
+			received = append(received, path)
+			return strings.ToUpper(path)
+		})
+		t.Cleanup(func() {
+			SetExpandPostProcessor(nil)
+		})
+
+		input := "${HOMEDIR_UNSET:-/tmp}/x/${HOME:-q}"
+		if actual, err := ExpandShell(input); err != nil || actual != "/TMP/X//ENV/HOME" {
+			t.Errorf("ExpandShell(%q) = %q, want %q (err: %v)", input, actual, "/TMP/X//ENV/HOME", err)
+		}
+		if len(received) != 1 || received[0] != "/tmp/x//env/home" {
+			t.Errorf("expected the processor to receive the substituted path, got %q", received)
+		}
+	})
+
+	t.Run("length limit after substitution", func(t *testing.T) {
+		patchEnv(t, "HOMEDIR_LONG", strings.Repeat("x", 64))
+		SetMaxPathLength(32)
+		t.Cleanup(func() {
+			SetMaxPathLength(0)
+		})
+		if actual, err := ExpandShell("/${HOMEDIR_LONG:-}"); err == nil {
+			t.Errorf("expected the substituted path to exceed the limit, got %q", actual)
+		}
+	})
+
+	t.Run("tilde after equals in default is not expanded", func(t *testing.T) {
+		SetExpandAfterEquals(true)
+		t.Cleanup(func() {
+			SetExpandAfterEquals(false)
+		})
+		if actual, err := ExpandShell("K=${HOMEDIR_UNSET:-~/x}"); err != nil || actual != "K=~/x" {
+			t.Errorf("ExpandShell(%q) = %q, want %q (err: %v)", "K=${HOMEDIR_UNSET:-~/x}", actual, "K=~/x", err)
+		}
+		if actual, err := ExpandShell("${HOMEDIR_UNSET:-K}=~/${HOMEDIR_UNSET:-x}"); err != nil || actual != "K="+filepath.Join("/home/me", "x") {
+			t.Errorf("expected both sides of the assignment to be substituted, got %q (err: %v)", actual, err)
+		}
+	})
+}
+
+func TestExpandGlobList(t *testing.T) {
+	restoreCache(t)
+	t.Cleanup(ClearHomeDir)
+
+	home := t.TempDir()
+	SetHomeDir(home)
+
+	for _, name := range []string{"a.so", "b.so", "c.txt", filepath.Join("nested", "d.so")} {
+		path := filepath.Join(home, ".app", "plugins", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatalf("failed to create file: %s", err)
+		}
+	}
+
+	plugins := filepath.Join(home, ".app", "plugins")
+
+	tests := []struct {
+		name     string
+		patterns []string
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "single pattern",
+			patterns: []string{"~/.app/plugins/*.so"},
+			expected: []string{filepath.Join(plugins, "a.so"), filepath.Join(plugins, "b.so")},
+		},
+		{
+			name:     "overlapping patterns are de-duplicated and sorted",
+			patterns: []string{"~/.app/plugins/b*", "~/.app/plugins/*.so", "~/.app/plugins/*/*.so", plugins + "/*.txt"},
+			expected: []string{
+				filepath.Join(plugins, "a.so"),
+				filepath.Join(plugins, "b.so"),
+				filepath.Join(plugins, "c.txt"),
+				filepath.Join(plugins, "nested", "d.so"),
+			},
+		},
+		{
+			name:     "no matches",
+			patterns: []string{"~/.app/plugins/*.dll"},
+			expected: []string{},
+		},
+		{
+			name:     "errors are aggregated",
+			patterns: []string{"~user/*.so", "~/.app/plugins/[", "~/.app/plugins/a*"},
+			expected: []string{filepath.Join(plugins, "a.so")},
+			err:      true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandGlobList(tc.patterns)
+			if (err != nil) != tc.err {
+				t.Fatalf("ExpandGlobList(%q) error: got %v, want error: %v", tc.patterns, err, tc.err)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("ExpandGlobList(%q) = %q, want %q", tc.patterns, actual, tc.expected)
+			}
+		})
+	}
+
+	t.Run("each failing pattern is reported", func(t *testing.T) {
+		_, err := ExpandGlobList([]string{"~user/*.so", "~/.app/plugins/["})
+		if err == nil {
+			t.Fatal("expected error but got none")
+		}
+		for _, pattern := range []string{"~user/*.so", "~/.app/plugins/["} {
+			if !strings.Contains(err.Error(), pattern) {
+				t.Errorf("expected error to mention %q, got: %v", pattern, err)
+			}
+		}
+	})
+}
+
+func TestContractMap(t *testing.T) {
+	restoreCache(t)
+
+	home := filepath.Join(string(filepath.Separator)+"home", "me")
+	SetHomeDir(home)
+
+	input := map[string]string{
+		"home":       home,
+		"cache":      filepath.Join(home, ".cache", "app"),
+		"outside":    filepath.Join(string(filepath.Separator)+"opt", "app"),
+		"sibling":    filepath.Join(string(filepath.Separator)+"home", "meme"),
+		"unclean":    "/opt//app/",
+		"name":       "my app",
+		"empty":      "",
+		"contracted": "~/already",
+	}
+	expected := map[string]string{
+		"home":       "~",
+		"cache":      "~" + string(filepath.Separator) + filepath.Join(".cache", "app"),
+		"outside":    filepath.Join(string(filepath.Separator)+"opt", "app"),
+		"sibling":    filepath.Join(string(filepath.Separator)+"home", "meme"),
+		"unclean":    "/opt//app/",
+		"name":       "my app",
+		"empty":      "",
+		"contracted": "~/already",
+	}
+
+	actual, err := ContractMap(input)
+	if err != nil {
+		t.Fatalf("ContractMap() failed: %s", err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if input["home"] != home {
+		t.Error("expected the input map to be left unchanged")
+	}
+}
+
+func TestExpandMap(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t)
+	SetUnknownUserPolicy(UnknownUserError)
+
+	home := filepath.Join(string(filepath.Separator)+"home", "me")
+	SetHomeDir(home)
+
+	config := map[string]string{
+		"home":    home,
+		"cache":   filepath.Join(home, ".cache", "app"),
+		"outside": filepath.Join(string(filepath.Separator)+"opt", "app"),
+		"name":    "my app",
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		contracted, err := ContractMap(config)
+		if err != nil {
+			t.Fatalf("ContractMap() failed: %s", err)
 		}
+		if contracted["cache"] == config["cache"] {
+			t.Fatalf("expected %q to be contracted", config["cache"])
+		}
+
+		expanded, err := ExpandMap(contracted)
+		if err != nil {
+			t.Fatalf("ExpandMap() failed: %s", err)
+		}
+		if !reflect.DeepEqual(expanded, config) {
+			t.Errorf("expected %v after round trip, got %v", config, expanded)
+		}
+
+		again, err := ContractMap(expanded)
+		if err != nil {
+			t.Fatalf("ContractMap() failed: %s", err)
+		}
+		if !reflect.DeepEqual(again, contracted) {
+			t.Errorf("expected stable contraction %v, got %v", contracted, again)
+		}
+	})
+
+	t.Run("errors are aggregated", func(t *testing.T) {
+		actual, err := ExpandMap(map[string]string{
+			"a":    "~mallory/a",
+			"b":    "~mallory/b",
+			"good": "~/good",
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		for _, key := range []string{`"a"`, `"b"`} {
+			if !strings.Contains(err.Error(), key) {
+				t.Errorf("expected error %q to mention %s", err, key)
+			}
+		}
+		if actual["a"] != "~mallory/a" || actual["good"] != filepath.Join(home, "good") {
+			t.Errorf("unexpected result %v", actual)
+		}
+	})
+}
+
+func TestContractAndShrink(t *testing.T) {
+	restoreCache(t)
+
+	home := filepath.Join(string(filepath.Separator)+"home", "alice")
+	SetHomeDir(home)
+
+	sep := string(filepath.Separator)
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{
+			name:   "under home",
+			input:  filepath.Join(home, "very", "long", "path"),
+			output: "~" + sep + filepath.Join("very", "long", "path"),
+		},
+		{
+			name:   "exactly home",
+			input:  home,
+			output: "~",
+		},
+		{
+			name:   "home with trailing separator",
+			input:  home + sep,
+			output: "~",
+		},
+		{
+			name:   "not under home",
+			input:  filepath.Join(sep+"opt", "app"),
+			output: filepath.Join(sep+"opt", "app"),
+		},
+		{
+			name:   "sibling with common prefix",
+			input:  home + "-other",
+			output: home + "-other",
+		},
+		{
+			name:   "relative path",
+			input:  filepath.Join("rel", "path"),
+			output: filepath.Join("rel", "path"),
+		},
+		{
+			name:   "empty path",
+			input:  "",
+			output: "",
+		},
+	}
 
-		patchEnv(t, homeEnv, "/custom/path")
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := Contract(tc.input)
+			if err != nil {
+				t.Fatalf("Contract(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("Contract(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
 
-		// reset cache to ensure we pick up the new home
+			if shrunk := Shrink(tc.input); shrunk != tc.output {
+				t.Errorf("Shrink(%q) = %q, want %q", tc.input, shrunk, tc.output)
+			}
+		})
+	}
+
+	t.Run("shrink keeps other paths unchanged", func(t *testing.T) {
+		input := sep + "opt" + sep + sep + "app" + sep
+		if shrunk := Shrink(input); shrunk != input {
+			t.Errorf("Shrink(%q) = %q, want %q", input, shrunk, input)
+		}
+	})
+
+	t.Run("shrink swallows errors", func(t *testing.T) {
+		ClearHomeDir()
+		origDetect := detect
+		t.Cleanup(func() { detect = origDetect })
+		detect = func() (string, error) { return "", errors.New("no home") }
 		Reset()
 
-		expected := filepath.Join("/custom/path", "foo/bar")
-		actual, err := Expand("~/foo/bar")
+		input := filepath.Join(home, "x")
+		if _, err := Contract(input); err == nil {
+			t.Error("expected Contract() to fail")
+		}
+		if shrunk := Shrink(input); shrunk != input {
+			t.Errorf("Shrink(%q) = %q, want %q", input, shrunk, input)
+		}
+	})
+}
 
-		if err != nil {
-			t.Errorf("no error expected, got: %v", err)
-		} else if actual != expected {
-			t.Errorf("expected: %v; actual: %v", expected, actual)
+func TestIsTilde(t *testing.T) {
+	restoreCache(t)
+
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"", false},
+		{"~", true},
+		{"~/foo", true},
+		{"~\\foo", true},
+		{"~user", true},
+		{"~user/foo", true},
+		{"/foo", false},
+		{"foo/~", false},
+		{"./~foo", false},
+		{" ~/foo", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			actual := IsTilde(tc.input)
+			if actual != tc.expected {
+				t.Errorf("IsTilde(%q) = %v, want %v", tc.input, actual, tc.expected)
+			}
+
+			// non-tilde paths are returned unchanged by Expand, tilde paths never are
+			expanded, err := Expand(tc.input)
+			passthrough := err == nil && expanded == tc.input
+			if actual == passthrough {
+				t.Errorf("IsTilde(%q) = %v disagrees with Expand() = %q (err: %v)", tc.input, actual, expanded, err)
+			}
+		})
+	}
+}
+
+func TestSetExpandCacheSize(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(true)
+	SetHomeDir("/home/me")
+	SetExpandCacheSize(2)
+
+	paths := []string{"~/a", "~/b", "~/c"}
+	for _, path := range paths {
+		if _, err := Expand(path); err != nil {
+			t.Fatalf("Expand(%q) failed: %s", path, err)
+		}
+	}
+
+	// the least recently used result is evicted
+	if _, ok := expandIntern.get("/home/me\x00~/a"); ok {
+		t.Error("expected least recently used result to be evicted")
+	}
+	if output, ok := expandIntern.get("/home/me\x00~/b"); !ok || output != filepath.Join("/home/me", "b") {
+		t.Errorf("expected cached result for %q, got %q (ok: %v)", "~/b", output, ok)
+	}
+
+	// a different home does not use results cached for the previous one
+	SetHomeDir("/home/other")
+	if actual, err := Expand("~/b"); err != nil || actual != filepath.Join("/home/other", "b") {
+		t.Errorf("expected %q after home change, got %q (err: %v)", filepath.Join("/home/other", "b"), actual, err)
+	}
+
+	Reset()
+	if _, entries := expandIntern.state(); len(entries) != 0 {
+		t.Errorf("expected Reset to clear the cache, got %d entries", len(entries))
+	}
+
+	SetExpandCacheSize(0)
+	if _, err := Expand("~/a"); err != nil {
+		t.Fatalf("Expand() failed: %s", err)
+	}
+	if _, entries := expandIntern.state(); len(entries) != 0 {
+		t.Errorf("expected disabled cache to stay empty, got %d entries", len(entries))
+	}
+}
+
+func TestSetExpandCacheEvictFunc(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(true)
+	SetHomeDir("/home/me")
+	SetExpandCacheSize(2)
+
+	var evicted [][2]string
+	SetExpandCacheEvictFunc(func(input, expanded string) {
+		evicted = append(evicted, [2]string{input, expanded})
+		// the cache lock is not held, so the callback may expand paths itself
+		if _, err := Expand("~/callback"); err != nil {
+			t.Errorf("Expand() in callback failed: %s", err)
+		}
+	})
+
+	for _, path := range []string{"~/a", "~/b", "~/c", "~/d"} {
+		if _, err := Expand(path); err != nil {
+			t.Fatalf("Expand(%q) failed: %s", path, err)
+		}
+	}
+
+	expected := [][2]string{
+		{"~/a", filepath.Join("/home/me", "a")},
+		{"~/b", filepath.Join("/home/me", "b")},
+	}
+	if len(evicted) < len(expected) || !reflect.DeepEqual(evicted[:len(expected)], expected) {
+		t.Errorf("evicted %q, want %q first", evicted, expected)
+	}
+
+	// clearing the cache is not an eviction
+	evicted = nil
+	Reset()
+	if len(evicted) != 0 {
+		t.Errorf("expected no evictions on Reset, got %q", evicted)
+	}
+
+	SetExpandCacheEvictFunc(nil)
+	for _, path := range []string{"~/a", "~/b", "~/c"} {
+		if _, err := Expand(path); err != nil {
+			t.Fatalf("Expand(%q) failed: %s", path, err)
+		}
+	}
+	if len(evicted) != 0 {
+		t.Errorf("expected no callbacks after unsetting, got %q", evicted)
+	}
+}
+
+func TestSetDirStack(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+	SetUnknownUserPolicy(UnknownUserError)
+
+	t.Run("no stack", func(t *testing.T) {
+		SetDirStack(nil)
+		if actual, err := Expand("~+0/x"); err == nil {
+			t.Errorf("expected error without a directory stack, got %q", actual)
+		}
+	})
+
+	SetDirStack([]string{"/top", "/middle", "/bottom"})
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "top of stack",
+			input:  "~+0",
+			output: "/top",
+		},
+		{
+			name:   "counting from the top",
+			input:  "~+1/x",
+			output: filepath.Join("/middle", "x"),
+		},
+		{
+			name:   "bottom of stack",
+			input:  "~-0",
+			output: "/bottom",
+		},
+		{
+			name:   "counting from the bottom",
+			input:  "~-2/x",
+			output: filepath.Join("/top", "x"),
+		},
+		{
+			name:  "out of range from the top",
+			input: "~+3",
+			err:   true,
+		},
+		{
+			name:  "out of range from the bottom",
+			input: "~-3",
+			err:   true,
+		},
+		{
+			name:   "plain tilde is unaffected",
+			input:  "~/x",
+			output: filepath.Join("/home/me", "x"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := Expand(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("Expand(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if actual != tc.output {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+}
+
+func TestExpandIdempotent(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1000", home: "/home/alice/"})
+	SetUnknownUserPolicy(UnknownUserPassthrough)
+
+	inputs := []string{
+		"~",
+		"~/",
+		"~/x",
+		"~/x/",
+		"~//x//y/",
+		`~\x`,
+		"~alice/x/",
+		"~mallory/x",
+		"/abs/path/",
+		"rel/path",
+		"",
+	}
+
+	configs := []struct {
+		name  string
+		home  string
+		setup func()
+	}{
+		{name: "defaults", home: "/home/me"},
+		{name: "trailing separator on home", home: "/home/me/"},
+		{name: "cache disabled", home: "/home/me", setup: func() { SetCacheEnable(false) }},
+		{name: "expand cache", home: "/home/me", setup: func() { SetExpandCacheSize(4) }},
+		{name: "force absolute home", home: "relative/home", setup: func() { SetForceAbsoluteHome(true) }},
+	}
+
+	funcs := []struct {
+		name   string
+		expand func(string) (string, error)
+	}{
+		{"Expand", Expand},
+		{"ExpandClean", ExpandClean},
+		{"ExpandAbs", ExpandAbs},
+		{"separator option", New(WithSeparator('/')).Expand},
+		{"tilde char option", New(WithTildeChar('@')).Expand},
+	}
+
+	for _, config := range configs {
+		t.Run(config.name, func(t *testing.T) {
+			restoreCache(t)
+			SetHomeDir(config.home)
+			if config.setup != nil {
+				config.setup()
+			}
+
+			for _, fn := range funcs {
+				for _, input := range inputs {
+					once, err := fn.expand(input)
+					if err != nil {
+						t.Fatalf("%s(%q) failed: %s", fn.name, input, err)
+					}
+					twice, err := fn.expand(once)
+					if err != nil {
+						t.Fatalf("%s(%q) failed: %s", fn.name, once, err)
+					}
+					if once != twice {
+						t.Errorf("%s is not idempotent for %q: %q, then %q", fn.name, input, once, twice)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestExpandLines(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+
+	input := strings.Join([]string{
+		"# plugin directories",
+		"~/plugins",
+		"",
+		"/opt/plugins",
+		"~/with space/dir",
+		"  ~/indented",
+		"#~/commented",
+		"~",
+	}, "\n")
+
+	expected := strings.Join([]string{
+		"# plugin directories",
+		filepath.Join("/home/me", "plugins"),
+		"",
+		"/opt/plugins",
+		filepath.Join("/home/me", "with space", "dir"),
+		"  ~/indented",
+		"#~/commented",
+		"~",
+	}, "\n") + "\n"
+
+	var out strings.Builder
+	if err := ExpandLines(strings.NewReader(input), &out); err != nil {
+		t.Fatalf("ExpandLines() failed: %s", err)
+	}
+	if out.String() != expected {
+		t.Errorf("ExpandLines() = %q, want %q", out.String(), expected)
+	}
+
+	t.Run("error reports line", func(t *testing.T) {
+		SetMaxPathLength(10)
+		err := ExpandLines(strings.NewReader("/ok\n~/a/long/path\n"), io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("expected error for line 2, got %v", err)
+		}
+	})
+}
+
+func TestExpandList(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	sep := string(os.PathListSeparator)
+	join := func(elements ...string) string {
+		return strings.Join(elements, sep)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "empty list",
+			input:  "",
+			output: "",
+		},
+		{
+			name:   "single element",
+			input:  "~/bin",
+			output: filepath.Join(home, "bin"),
+		},
+		{
+			name:   "mixed elements",
+			input:  join("~/bin", "/usr/bin", "~/.local/bin"),
+			output: join(filepath.Join(home, "bin"), "/usr/bin", filepath.Join(home, ".local/bin")),
+		},
+		{
+			name:   "empty elements preserved",
+			input:  join("", "~/bin", "", "/usr/bin", ""),
+			output: join("", filepath.Join(home, "bin"), "", "/usr/bin", ""),
+		},
+		{
+			name:  "user-specific element",
+			input: join("~/bin", "~user/bin"),
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ExpandList(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("ExpandList(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+
+			if actual != tc.output {
+				t.Errorf("ExpandList(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	t.Run("error reports failing element", func(t *testing.T) {
+		_, err := ExpandList(join("~/bin", "~user/bin"))
+		if err == nil {
+			t.Fatal("expected error but got none")
+		}
+		if !strings.Contains(err.Error(), "element 1") || !strings.Contains(err.Error(), "~user/bin") {
+			t.Errorf("expected error to identify the failing element, got: %v", err)
 		}
 	})
 }
@@ -414,3 +4519,84 @@ func BenchmarkDir(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkExpand(b *testing.B) {
+	restoreCache(b)
+
+	tests := []struct {
+		name     string
+		useCache bool
+	}{
+		{"cached", true},
+		{"uncached", false},
+	}
+
+	for _, tc := range tests {
+		b.Run(tc.name, func(b *testing.B) {
+			SetCacheEnable(tc.useCache)
+			Reset()
+
+			// warmup
+			_, err := Expand("~/.config/app")
+			if err != nil {
+				b.Fatal("warmup failed:", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := Expand("~/.config/app")
+				if err != nil {
+					b.Fatal("Expand() failed:", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExpandPassthrough(b *testing.B) {
+	restoreCache(b)
+	SetCacheEnable(true)
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"clean non-tilde", "/usr/local/share/app"},
+		{"clean tilde", "~/.local/share/app"},
+	}
+
+	for _, tc := range tests {
+		b.Run(tc.name, func(b *testing.B) {
+			Reset()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := Expand(tc.input)
+				if err != nil {
+					b.Fatal("Expand() failed:", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExpandCacheSize(b *testing.B) {
+	restoreCache(b)
+	SetCacheEnable(true)
+
+	// alternating between several paths defeats the single-entry cache
+	paths := []string{"~/.config/app", "~/.cache/app", "~/.local/share/app", "~/.local/state/app"}
+
+	for _, size := range []int{0, len(paths)} {
+		b.Run(fmt.Sprintf("size %d", size), func(b *testing.B) {
+			SetExpandCacheSize(size)
+			Reset()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := Expand(paths[i%len(paths)]); err != nil {
+					b.Fatal("Expand() failed:", err)
+				}
+			}
+		})
+	}
+}
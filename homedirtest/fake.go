@@ -0,0 +1,62 @@
+// Package homedirtest provides test helpers for code that depends on a homedir.Resolver.
+package homedirtest
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/anchore/go-homedir"
+)
+
+// Option configures a fake Resolver.
+type Option func(*fakeResolver)
+
+// WithDirError makes Dir (and therefore the expansion of tilde paths) return
+// the given error.
+func WithDirError(err error) Option {
+	return func(r *fakeResolver) {
+		r.err = err
+	}
+}
+
+type fakeResolver struct {
+	home string
+	err  error
+}
+
+// NewFakeResolver returns a homedir.Resolver that always resolves the home
+// directory to home and expands tilde paths against it, without consulting the
+// environment or looking up users. `~user` paths are rejected.
+func NewFakeResolver(home string, opts ...Option) homedir.Resolver {
+	r := &fakeResolver{home: home}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *fakeResolver) Dir() (string, error) {
+	if r.err != nil {
+		return "", r.err
+	}
+	return r.home, nil
+}
+
+func (r *fakeResolver) Expand(path string) (string, error) {
+	if !homedir.IsTilde(path) {
+		return path, nil
+	}
+
+	if len(path) > 1 && path[1] != '/' && path[1] != '\\' {
+		return "", fmt.Errorf("cannot expand user-specific home dir %q: %w", path, homedir.ErrUnknownUser)
+	}
+
+	dir, err := r.Dir()
+	if err != nil {
+		return "", err
+	}
+	if len(path) == 1 {
+		return dir, nil
+	}
+	return filepath.Join(dir, path[1:]), nil
+}
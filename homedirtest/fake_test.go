@@ -0,0 +1,76 @@
+package homedirtest
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewFakeResolver(t *testing.T) {
+	r := NewFakeResolver("/fake/home")
+
+	dir, err := r.Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+	if dir != "/fake/home" {
+		t.Errorf("expected %q, got %q", "/fake/home", dir)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "tilde with path",
+			input:  "~/foo",
+			output: filepath.Join("/fake/home", "foo"),
+		},
+		{
+			name:   "tilde only",
+			input:  "~",
+			output: "/fake/home",
+		},
+		{
+			name:   "non-tilde path",
+			input:  "/foo",
+			output: "/foo",
+		},
+		{
+			name:  "tilde with user",
+			input: "~user/foo",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := r.Expand(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("Expand(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if actual != tc.output {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+}
+
+func TestWithDirError(t *testing.T) {
+	errNoHome := errors.New("no home")
+	r := NewFakeResolver("/fake/home", WithDirError(errNoHome))
+
+	if _, err := r.Dir(); !errors.Is(err, errNoHome) {
+		t.Errorf("expected Dir() error %v, got %v", errNoHome, err)
+	}
+	if _, err := r.Expand("~/foo"); !errors.Is(err, errNoHome) {
+		t.Errorf("expected Expand() error %v, got %v", errNoHome, err)
+	}
+
+	// non-tilde paths do not need the home directory
+	if actual, err := r.Expand("/foo"); err != nil || actual != "/foo" {
+		t.Errorf("expected %q, got %q (err: %v)", "/foo", actual, err)
+	}
+}
@@ -0,0 +1,129 @@
+package homedir
+
+import "strings"
+
+// Resolver resolves the home directory and expands paths against it. Code that
+// depends on the home directory can accept a Resolver, so tests can pass a
+// fake implementation instead of the real one (see New).
+type Resolver interface {
+	Dir() (string, error)
+	Expand(path string) (string, error)
+}
+
+var _ Resolver = (*Homedir)(nil)
+
+// Homedir expands paths using a fixed set of options, configured via New.
+// Home directory resolution (detection, caching and overrides) is shared with
+// the package-level functions; the options only affect how paths are expanded.
+// The options are applied once by New, so a Homedir can be created up front
+// and reused (also concurrently) to expand many paths, e.g. in a hot loop.
+type Homedir struct {
+	separator       byte
+	tilde           rune
+	acceptBackslash bool
+
+	// derived from the options by New
+	marker   string
+	replacer *strings.Replacer
+}
+
+// Option configures a Homedir.
+type Option func(*Homedir)
+
+// New returns a Homedir configured with the given options. Without any
+// options, it behaves exactly like the package-level functions.
+func New(opts ...Option) *Homedir {
+	h := &Homedir{}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if h.tilde != 0 && h.tilde != '~' {
+		h.marker = string(h.tilde)
+	}
+	if h.separator != 0 {
+		sep := string(h.separator)
+		h.replacer = strings.NewReplacer("/", sep, `\`, sep)
+	}
+	return h
+}
+
+// WithSeparator makes Expand join the home directory and the rest of the path
+// with the given separator (converting any `/` or `\` in the rest of the path)
+// instead of using filepath.Join. This is meant for generating paths for
+// another OS, e.g. `~\docs` on a Linux host with a Windows-style home. It is
+// not meant for accessing the filesystem: the result is not cleaned.
+func WithSeparator(sep byte) Option {
+	return func(h *Homedir) {
+		h.separator = sep
+	}
+}
+
+// WithTildeChar makes Expand recognize the given marker instead of `~` as the
+// home directory prefix, for both the `~` and `~user` forms (e.g. `@/docs` and
+// `@alice/docs` with '@'). Paths prefixed with `~` are then returned as-is,
+// like any other path without the marker.
+func WithTildeChar(r rune) Option {
+	return func(h *Homedir) {
+		h.tilde = r
+	}
+}
+
+// WithAcceptBackslashTilde makes Expand treat all backslashes in tilde paths
+// as separators regardless of the OS, so that Windows-style paths such as
+// `~\docs\notes` expand to `<home>/docs/notes` on Unix as well. By default,
+// only a backslash directly after the tilde (or `~user`) prefix is a separator
+// on every OS; further backslashes are only separators on Windows, as they
+// may be part of file names on other systems.
+func WithAcceptBackslashTilde(accept bool) Option {
+	return func(h *Homedir) {
+		h.acceptBackslash = accept
+	}
+}
+
+// Dir returns the home directory for the executing user (see Dir).
+func (h *Homedir) Dir() (string, error) {
+	return Dir()
+}
+
+// Expand expands the path to include the home directory if the path is
+// prefixed with `~` (see Expand), applying the options of the Homedir.
+func (h *Homedir) Expand(path string) (string, error) {
+	tildePath := path
+	if h.marker != "" {
+		if !strings.HasPrefix(path, h.marker) {
+			return path, nil
+		}
+		tildePath = "~" + path[len(h.marker):]
+	}
+	if h.acceptBackslash && IsTilde(tildePath) {
+		tildePath = strings.ReplaceAll(tildePath, `\`, "/")
+	}
+
+	result, err := h.expand(tildePath)
+	if err != nil {
+		return "", err
+	}
+	if tildePath != path && result.Home == "" {
+		// left unexpanded (see SetUnknownUserPolicy)
+		return path, nil
+	}
+	return result.Path, nil
+}
+
+func (h *Homedir) expand(path string) (ExpandResult, error) {
+	if h.separator == 0 {
+		return ExpandRich(path)
+	}
+
+	// like ExpandRich, only joining the home directory and the rest of the path differently
+	return expandRich(path, expandHooks{join: h.joinWithSeparator})
+}
+
+func (h *Homedir) joinWithSeparator(home, rest string) string {
+	rest = strings.Trim(rest, `/\`)
+	if rest == "" {
+		return home
+	}
+	return strings.TrimRight(home, `/\`) + string(h.separator) + h.replacer.Replace(rest)
+}
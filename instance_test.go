@@ -0,0 +1,423 @@
+package homedir
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	restoreCache(t)
+
+	h := New()
+
+	dir, err := h.Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+	expected, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+	if dir != expected {
+		t.Errorf("expected %q, got %q", expected, dir)
+	}
+
+	expanded, err := h.Expand("~/foo")
+	if err != nil {
+		t.Fatalf("Expand() failed: %s", err)
+	}
+	if want := filepath.Join(expected, "foo"); expanded != want {
+		t.Errorf("expected %q, got %q", want, expanded)
+	}
+}
+
+func TestWithSeparator(t *testing.T) {
+	restoreCache(t)
+	t.Cleanup(ClearHomeDir)
+
+	tests := []struct {
+		name   string
+		home   string
+		sep    byte
+		input  string
+		output string
+	}{
+		{
+			name:   "windows separator",
+			home:   `C:\Users\x`,
+			sep:    '\\',
+			input:  `~\docs`,
+			output: `C:\Users\x\docs`,
+		},
+		{
+			name:   "windows separator with forward slashes",
+			home:   `C:\Users\x`,
+			sep:    '\\',
+			input:  "~/docs/notes",
+			output: `C:\Users\x\docs\notes`,
+		},
+		{
+			name:   "unix separator",
+			home:   "/home/x",
+			sep:    '/',
+			input:  `~\docs\notes`,
+			output: "/home/x/docs/notes",
+		},
+		{
+			name:   "trailing separator on home",
+			home:   "/home/x/",
+			sep:    '/',
+			input:  "~/docs",
+			output: "/home/x/docs",
+		},
+		{
+			name:   "tilde only",
+			home:   `C:\Users\x`,
+			sep:    '\\',
+			input:  "~",
+			output: `C:\Users\x`,
+		},
+		{
+			name:   "non-tilde path",
+			home:   `C:\Users\x`,
+			sep:    '\\',
+			input:  "/foo/bar",
+			output: "/foo/bar",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetHomeDir(tc.home)
+
+			actual, err := New(WithSeparator(tc.sep)).Expand(tc.input)
+			if err != nil {
+				t.Fatalf("Expand(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	// like Expand, a relative home is rejected
+	SetHomeDir("relative/home")
+	if actual, err := New(WithSeparator('/')).Expand("~/docs"); err == nil {
+		t.Errorf("expected an error for a relative home, got %q", actual)
+	}
+}
+
+func TestWithTildeChar(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1000", home: "/home/alice"})
+	SetHomeDir("/home/me")
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "marker",
+			opts:   []Option{WithTildeChar('@')},
+			input:  "@",
+			output: "/home/me",
+		},
+		{
+			name:   "marker with path",
+			opts:   []Option{WithTildeChar('@')},
+			input:  "@/docs",
+			output: filepath.Join("/home/me", "docs"),
+		},
+		{
+			name:   "marker with user",
+			opts:   []Option{WithTildeChar('@')},
+			input:  "@alice/docs",
+			output: filepath.Join("/home/alice", "docs"),
+		},
+		{
+			name:  "marker with unknown user",
+			opts:  []Option{WithTildeChar('@')},
+			input: "@mallory/docs",
+			err:   true,
+		},
+		{
+			name:   "tilde is not expanded",
+			opts:   []Option{WithTildeChar('@')},
+			input:  "~/docs",
+			output: "~/docs",
+		},
+		{
+			name:   "multi-byte marker",
+			opts:   []Option{WithTildeChar('§')},
+			input:  "§/docs",
+			output: filepath.Join("/home/me", "docs"),
+		},
+		{
+			name:   "marker with separator",
+			opts:   []Option{WithTildeChar('@'), WithSeparator('\\')},
+			input:  "@/docs/notes",
+			output: `/home/me\docs\notes`,
+		},
+		{
+			name:   "default marker",
+			opts:   []Option{WithTildeChar('~')},
+			input:  "~/docs",
+			output: filepath.Join("/home/me", "docs"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := New(tc.opts...).Expand(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("Expand(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if actual != tc.output {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	t.Run("unknown user left unexpanded", func(t *testing.T) {
+		SetUnknownUserPolicy(UnknownUserPassthrough)
+		actual, err := New(WithTildeChar('@')).Expand("@mallory/docs")
+		if err != nil || actual != "@mallory/docs" {
+			t.Errorf("expected %q, got %q (err: %v)", "@mallory/docs", actual, err)
+		}
+	})
+
+	t.Run("expanded to the tilde form", func(t *testing.T) {
+		// a result that happens to read like the rewritten path is still an expansion
+		SetExpandPostProcessor(func(path string) string {
+			return strings.Replace(path, "/home/me", "~", 1)
+		})
+		defer SetExpandPostProcessor(nil)
+		actual, err := New(WithTildeChar('@'), WithSeparator('/')).Expand("@/docs")
+		if err != nil || actual != "~/docs" {
+			t.Errorf("expected %q, got %q (err: %v)", "~/docs", actual, err)
+		}
+	})
+}
+
+// fixedResolver is a minimal Resolver implementation that expands against a fixed home
+type fixedResolver string
+
+func (r fixedResolver) Dir() (string, error) {
+	return string(r), nil
+}
+
+func (r fixedResolver) Expand(path string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return filepath.Join(string(r), path[1:]), nil
+	}
+	return path, nil
+}
+
+func TestResolver(t *testing.T) {
+	restoreCache(t)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	// configDir is an example of downstream code accepting a Resolver
+	configDir := func(r Resolver) (string, error) {
+		return r.Expand("~/.config")
+	}
+
+	tests := []struct {
+		name     string
+		resolver Resolver
+		expected string
+	}{
+		{
+			name:     "default instance",
+			resolver: New(),
+			expected: filepath.Join(home, ".config"),
+		},
+		{
+			name:     "custom implementation",
+			resolver: fixedResolver("/fake/home"),
+			expected: filepath.Join("/fake/home", ".config"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := configDir(tc.resolver)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWithAcceptBackslashTilde(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("backslashes are always separators on Windows")
+	}
+	restoreCache(t)
+	SetHomeDir("/home/me")
+
+	tests := []struct {
+		name   string
+		accept bool
+		input  string
+		output string
+	}{
+		{
+			name:   "accepted",
+			accept: true,
+			input:  `~\docs\notes`,
+			output: "/home/me/docs/notes",
+		},
+		{
+			name:   "accepted with forward slashes",
+			accept: true,
+			input:  "~/docs/notes",
+			output: "/home/me/docs/notes",
+		},
+		{
+			name:   "accepted on non-tilde path",
+			accept: true,
+			input:  `docs\notes`,
+			output: `docs\notes`,
+		},
+		{
+			name:   "not accepted",
+			input:  `~\docs\notes`,
+			output: `/home/me/\docs\notes`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := New(WithAcceptBackslashTilde(tc.accept)).Expand(tc.input)
+			if err != nil {
+				t.Fatalf("Expand(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+}
+
+func BenchmarkHomedirExpand(b *testing.B) {
+	restoreCache(b)
+	SetCacheEnable(true)
+
+	tests := []struct {
+		name  string
+		h     *Homedir
+		input string
+	}{
+		{"no options", New(), "~/.config/app"},
+		{"separator", New(WithSeparator('\\')), "~/.config/app"},
+		{"tilde char", New(WithTildeChar('@')), "@/.config/app"},
+		{"backslash tilde", New(WithAcceptBackslashTilde(true)), `~\.config\app`},
+	}
+
+	for _, tc := range tests {
+		b.Run(tc.name, func(b *testing.B) {
+			Reset()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := tc.h.Expand(tc.input); err != nil {
+					b.Fatal("Expand() failed:", err)
+				}
+			}
+		})
+	}
+}
+
+// TestInstanceParity runs the same inputs through the package-level functions
+// and a Homedir without options, under various settings, to guard against the
+// two drifting apart. The options of a Homedir change the expansion on
+// purpose, so they are excluded, except for WithSeparator on inputs that need
+// no cleaning: it still has to honor the settings that are not about joining
+// paths (e.g. the unknown user policy or the path length limit).
+func TestInstanceParity(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1001", home: "/home/alice"})
+
+	settings := []struct {
+		name  string
+		apply func()
+		// the home is relative, which WithSeparator does not check
+		relativeHome bool
+	}{
+		{name: "defaults", apply: func() {}},
+		{name: "cache disabled", apply: func() { SetCacheEnable(false) }},
+		{name: "DisableCache", apply: func() { DisableCache = true }},
+		{name: "expand cache", apply: func() { SetExpandCacheSize(4) }},
+		{name: "unknown user passthrough", apply: func() { SetUnknownUserPolicy(UnknownUserPassthrough) }},
+		{name: "unknown user warning", apply: func() {
+			SetLogger(&recordingLogger{})
+			SetUnknownUserPolicy(UnknownUserPassthroughWithWarn)
+		}},
+		{name: "expand after equals", apply: func() { SetExpandAfterEquals(true) }},
+		{name: "dir stack", apply: func() { SetDirStack([]string{"/stack/top", "/stack/bottom"}) }},
+		{name: "registered home", apply: func() { RegisterHome("alice", "/srv/alice") }},
+		{name: "max path length", apply: func() { SetMaxPathLength(12) }},
+		{name: "relative home", relativeHome: true, apply: func() { SetHomeDir("relative/home") }},
+		{name: "relative home made absolute", relativeHome: true, apply: func() {
+			SetHomeDir("relative/home")
+			SetForceAbsoluteHome(true)
+		}},
+	}
+
+	inputs := []string{
+		"", "~", "~/x", "~/x/y", "~//a/../b", "~alice/x", "~mallory/x", "~bad:name/x",
+		"KEY=~/x", "~+0/x", "~-1", "/abs/path", "rel/path",
+	}
+	// inputs whose expansion needs no cleaning, so WithSeparator agrees with filepath.Join
+	cleanInputs := map[string]bool{"": true, "~": true, "~/x": true, "~/x/y": true, "~alice/x": true, "KEY=~/x": true, "~+0/x": true, "/abs/path": true, "rel/path": true}
+
+	for _, s := range settings {
+		t.Run(s.name, func(t *testing.T) {
+			state := Snapshot()
+			t.Cleanup(func() {
+				Restore(state)
+				DisableCache = false
+			})
+			SetHomeDir("/home/me")
+			s.apply()
+
+			h := New()
+			sep := New(WithSeparator(filepath.Separator))
+
+			expectedDir, expectedErr := Dir()
+			if dir, err := h.Dir(); dir != expectedDir || (err == nil) != (expectedErr == nil) {
+				t.Errorf("Homedir.Dir() = %q (err: %v), want %q (err: %v)", dir, err, expectedDir, expectedErr)
+			}
+
+			for _, input := range inputs {
+				expected, expectedErr := Expand(input)
+				actual, err := h.Expand(input)
+				if actual != expected || (err == nil) != (expectedErr == nil) {
+					t.Errorf("Homedir.Expand(%q) = %q (err: %v), want %q (err: %v)", input, actual, err, expected, expectedErr)
+				}
+
+				// on windows, the forward slashes of the home are not converted by WithSeparator
+				if !cleanInputs[input] || s.relativeHome || runtime.GOOS == "windows" {
+					continue
+				}
+				actual, err = sep.Expand(input)
+				if actual != expected || (err == nil) != (expectedErr == nil) {
+					t.Errorf("Homedir.Expand(%q) with separator = %q (err: %v), want %q (err: %v)", input, actual, err, expected, expectedErr)
+				}
+			}
+		})
+	}
+}
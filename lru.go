@@ -0,0 +1,149 @@
+package homedir
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruUnbounded is the size of an lruCache that never evicts entries.
+const lruUnbounded = 0
+
+// lruCache is a string-keyed cache that evicts the least recently used entry
+// once it holds more than size entries (see lruUnbounded). It is safe for
+// concurrent use.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of lruEntry, most recently used first
+	entries map[string]*list.Element
+
+	// onEvict is called (without holding mu) for every entry evicted by add or
+	// resize, if set. It must be set before the cache is used.
+	onEvict func(entry lruEntry)
+}
+
+// lruEntry is a single cached key/value pair.
+type lruEntry struct {
+	key   string
+	value string
+}
+
+func newLRUCache() *lruCache {
+	return &lruCache{
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// capacity returns the maximum number of entries (lruUnbounded for no limit).
+func (c *lruCache) capacity() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+func (c *lruCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(lruEntry).value, true
+}
+
+func (c *lruCache) add(key, value string) {
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = lruEntry{key: key, value: value}
+		c.order.MoveToFront(elem)
+		c.mu.Unlock()
+		return
+	}
+	c.entries[key] = c.order.PushFront(lruEntry{key: key, value: value})
+	evicted := c.evictLocked()
+	c.mu.Unlock()
+
+	c.notifyEvicted(evicted)
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lruCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *lruCache) resize(size int) {
+	c.mu.Lock()
+	c.size = size
+	evicted := c.evictLocked()
+	c.mu.Unlock()
+
+	c.notifyEvicted(evicted)
+}
+
+// state returns the size and the entries of the cache, least recently used first.
+func (c *lruCache) state() (int, []lruEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]lruEntry, 0, c.order.Len())
+	for elem := c.order.Back(); elem != nil; elem = elem.Prev() {
+		entries = append(entries, elem.Value.(lruEntry))
+	}
+	return c.size, entries
+}
+
+// restore replaces the size and the entries of the cache (as returned by state).
+func (c *lruCache) restore(size int, entries []lruEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = size
+	c.order.Init()
+	c.entries = make(map[string]*list.Element, len(entries))
+	for _, entry := range entries {
+		c.entries[entry.key] = c.order.PushFront(entry)
+	}
+	c.evictLocked()
+}
+
+// evictLocked evicts the least recently used entries exceeding the size,
+// returning them oldest first.
+func (c *lruCache) evictLocked() []lruEntry {
+	var evicted []lruEntry
+	for c.size != lruUnbounded && c.order.Len() > c.size {
+		elem := c.order.Back()
+		c.order.Remove(elem)
+		entry := elem.Value.(lruEntry)
+		delete(c.entries, entry.key)
+		evicted = append(evicted, entry)
+	}
+	return evicted
+}
+
+// notifyEvicted calls onEvict for the given entries. It must be called
+// without holding mu, so that the callback may use the cache.
+func (c *lruCache) notifyEvicted(evicted []lruEntry) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, entry := range evicted {
+		c.onEvict(entry)
+	}
+}
@@ -0,0 +1,29 @@
+package homedir
+
+import "syscall"
+
+// networkFSNames are the names of network filesystems as reported by statfs.
+var networkFSNames = map[string]bool{
+	"nfs":    true,
+	"smbfs":  true,
+	"afpfs":  true,
+	"webdav": true,
+	"cifs":   true,
+	"ftp":    true,
+}
+
+func isNetworkFS(path string) (bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false, err
+	}
+
+	name := make([]byte, 0, len(stat.Fstypename))
+	for _, c := range stat.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return networkFSNames[string(name)], nil
+}
@@ -0,0 +1,29 @@
+package homedir
+
+import "syscall"
+
+// networkFSTypes are the statfs f_type magic numbers of network filesystems (see statfs(2)).
+var networkFSTypes = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517b:     true, // SMB
+	0xff534d42: true, // CIFS
+	0xfe534d42: true, // SMB2
+	0x564c:     true, // NCP
+	0x73757245: true, // Coda
+	0x5346414f: true, // AFS
+	0x6b414653: true, // kAFS
+	0x01021997: true, // 9P
+	0x00c36400: true, // Ceph
+	0x01161970: true, // GFS2
+	0x7461636f: true, // OCFS2
+	0x0bd00bd0: true, // Lustre
+}
+
+func isNetworkFS(path string) (bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false, err
+	}
+	// the width and signedness of f_type differ between architectures
+	return networkFSTypes[uint32(stat.Type)], nil
+}
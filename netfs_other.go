@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package homedir
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func isNetworkFS(string) (bool, error) {
+	return false, fmt.Errorf("detecting network filesystems is not supported on %s", runtime.GOOS)
+}
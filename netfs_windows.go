@@ -0,0 +1,31 @@
+package homedir
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// GetDriveType results for invalid roots and network drives.
+const (
+	driveNoRootDir = 1
+	driveRemote    = 4
+)
+
+var procGetDriveTypeW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDriveTypeW")
+
+func isNetworkFS(path string) (bool, error) {
+	// the root of the drive or UNC share, e.g. `C:\` or `\\server\share\`
+	root := filepath.VolumeName(path) + `\`
+	p, err := syscall.UTF16PtrFromString(root)
+	if err != nil {
+		return false, err
+	}
+
+	r, _, _ := procGetDriveTypeW.Call(uintptr(unsafe.Pointer(p)))
+	if r == driveNoRootDir {
+		return false, fmt.Errorf("invalid root %q", root)
+	}
+	return r == driveRemote, nil
+}
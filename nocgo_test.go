@@ -0,0 +1,38 @@
+//go:build !cgo
+
+package homedir
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// the package never uses os/user, so detection must work the same in static (CGO_ENABLED=0) binaries
+func TestDirWithoutCgo(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skipf("HOME is not the primary variable on %s", runtime.GOOS)
+	}
+	restoreCache(t)
+	ClearHomeDir()
+	Reset()
+
+	home := t.TempDir()
+	patchEnv(t, "HOME", home)
+
+	dir, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+	if dir != home {
+		t.Errorf("expected %q, got %q", home, dir)
+	}
+
+	expanded, err := Expand("~/x")
+	if err != nil {
+		t.Fatalf("Expand() failed: %s", err)
+	}
+	if want := filepath.Join(home, "x"); expanded != want {
+		t.Errorf("expected %q, got %q", want, expanded)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !unix
+
+package homedir
+
+import (
+	"fmt"
+	"io/fs"
+	"runtime"
+)
+
+// HomeDirOwning returns the home directory of the user owning the file or
+// directory at the given path. This is not supported on this platform.
+func HomeDirOwning(path string) (string, error) {
+	return "", fmt.Errorf("resolving the owner of %q is not supported on %s", path, runtime.GOOS)
+}
+
+// privateToCurrentUser reports whether the file is owned by the current user
+// and cannot be written by anyone else. As ownership cannot be checked on
+// this platform, all files are accepted.
+func privateToCurrentUser(info fs.FileInfo) bool {
+	return true
+}
+
+// privateDir reports whether the file is a directory (not a symlink) owned by
+// the current user with mode 0700. As ownership cannot be checked on this
+// platform, any directory is accepted.
+func privateDir(info fs.FileInfo) bool {
+	return info.IsDir()
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package homedir
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// HomeDirOwning returns the home directory of the user owning the file or
+// directory at the given path (see DirForUID).
+func HomeDirOwning(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("unable to determine the owner of %q", path)
+	}
+	return DirForUID(int(stat.Uid))
+}
+
+// privateToCurrentUser reports whether the file is owned by the current
+// (effective) user and cannot be written by anyone else.
+func privateToCurrentUser(info fs.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == os.Geteuid() && info.Mode().Perm()&0o022 == 0
+}
+
+// privateDir reports whether the file is a directory (not a symlink) owned by
+// the current (effective) user with mode 0700.
+func privateDir(info fs.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.IsDir() && int(stat.Uid) == os.Geteuid() && info.Mode().Perm() == 0o700
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package homedir
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestHomeDirOwning(t *testing.T) {
+	stubLookupUser(t, passwdEntry{name: "owner", uid: strconv.Itoa(os.Getuid()), home: "/home/owner"})
+
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+
+	dir, err := HomeDirOwning(path)
+	if err != nil {
+		t.Fatalf("HomeDirOwning() failed: %s", err)
+	}
+	if dir != "/home/owner" {
+		t.Errorf("expected %q, got %q", "/home/owner", dir)
+	}
+
+	if _, err := HomeDirOwning(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected a not-exist error for a missing path, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package homedir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// hintVersion is the first line of a hint file, identifying its format.
+const hintVersion = "go-homedir-hint-v1"
+
+// persistentCachePath stores the hint file set via EnablePersistentCache (empty when disabled)
+var persistentCachePath atomic.Value
+
+func init() {
+	persistentCachePath.Store("")
+}
+
+// EnablePersistentCache makes Dir persist the detected home directory in a
+// small hint file at the given path, and reuse it on subsequent runs of the
+// process instead of running detection again. This is meant for short-lived
+// CLI tools that are invoked many times in a row. The hint is only reused if
+// it was written by the same user with the same detection settings in the
+// same environment (i.e. all consulted environment variables are unchanged,
+// see ConsultedEnvVars), and if the validator accepts it (see
+// SetHomeValidator); otherwise detection runs as usual and the hint is
+// replaced. The hermetic fallback (see SetHermeticFallback) is never persisted,
+// so detection is retried on the next run. On Unix systems, a hint file that is not owned by the current
+// (effective) user or that is writable by others is ignored. Failing to read
+// or write the hint file is not an error (writing failures are logged, see
+// SetLogger). Like the other caches, the hint file is only used when caching
+// is enabled. It is never used when the environment is ignored (see
+// SetIgnoreEnv), as the hint file cannot be trusted more than the
+// environment. An empty path disables the persistent cache (the default).
+func EnablePersistentCache(path string) {
+	persistentCachePath.Store(path)
+}
+
+// detectWithHint runs detection, consulting the hint file first (see EnablePersistentCache).
+func detectWithHint() (string, error) {
+	path := persistentCachePath.Load().(string)
+	if path == "" || !caching() || ignoreEnv.Load() {
+		return detect()
+	}
+
+	fingerprint := hintFingerprint()
+	if dir, ok := readHint(path, fingerprint); ok {
+		validate := homeValidator.Load().(validatorEntry).validate
+		if validate == nil || validate(dir) == nil {
+			return dir, nil
+		}
+	}
+
+	dir, err := detect()
+	if err != nil {
+		return "", err
+	}
+	if fallback, ok := hermeticHome(); ok && dir == fallback.dir {
+		// the fallback stands in for a failed detection, which should be retried next time
+		return dir, nil
+	}
+	if err := writeHint(path, fingerprint, dir); err != nil {
+		warnf("homedir: cannot write hint file %q: %v", path, err)
+	}
+	return dir, nil
+}
+
+// hintFingerprint identifies the user, detection settings and environment a hint is valid for.
+func hintFingerprint() string {
+	settings := fmt.Sprintf("primary=%s ssh=%t logname=%t service=%t validator=%t hermetic=%s passwd=%s platform=%+v",
+		primaryEnvVar.Load().(string),
+		respectSSHUser.Load(),
+		lognameFallback.Load(),
+		windowsServiceProfile.Load(),
+		homeValidator.Load().(validatorEntry).validate != nil,
+		hermeticFallback.Load().(hermeticEntry).dir,
+		passwdPath.Load().(string),
+		snapshotPlatform(),
+	)
+	sum := sha256.Sum256([]byte(strconv.Itoa(os.Geteuid()) + "\x00" + settings + "\x00" + envFingerprint()))
+	return hex.EncodeToString(sum[:])
+}
+
+func readHint(path, fingerprint string) (string, bool) {
+	// another user could otherwise plant a hint pointing anywhere
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || !privateToCurrentUser(info) {
+		return "", false
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+
+	// version, fingerprint, home directory
+	lines := strings.SplitN(string(contents), "\n", 3)
+	if len(lines) != 3 || lines[0] != hintVersion || lines[1] != fingerprint {
+		return "", false
+	}
+	dir := strings.TrimSuffix(lines[2], "\n")
+	if dir == "" {
+		return "", false
+	}
+	return dir, true
+}
+
+func writeHint(path, fingerprint, dir string) error {
+	// write to a temporary file first, so concurrent readers never see a partial hint
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(hintVersion + "\n" + fingerprint + "\n" + dir + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
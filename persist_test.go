@@ -0,0 +1,252 @@
+package homedir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestEnablePersistentCache(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(true)
+	ClearHomeDir()
+
+	original := detect
+	t.Cleanup(func() { detect = original })
+	attempts := 0
+	detect = func() (string, error) {
+		attempts++
+		return "/detected/" + os.Getenv("HOME"), nil
+	}
+
+	hint := filepath.Join(t.TempDir(), "home.hint")
+	EnablePersistentCache(hint)
+
+	assertDir := func(t *testing.T, expected string, expectedAttempts int) {
+		t.Helper()
+		// simulate a new process by clearing the in-memory cache
+		Reset()
+		if actual, err := Dir(); err != nil || actual != expected {
+			t.Errorf("Dir() = %q, want %q (err: %v)", actual, expected, err)
+		}
+		if attempts != expectedAttempts {
+			t.Errorf("expected %d detection attempts, got %d", expectedAttempts, attempts)
+		}
+	}
+
+	patchEnv(t, "HOME", "a")
+	assertDir(t, "/detected/a", 1)
+	contents, err := os.ReadFile(hint)
+	if err != nil {
+		t.Fatalf("expected a hint file to be written: %s", err)
+	}
+	if !strings.Contains(string(contents), "/detected/a") {
+		t.Errorf("expected the hint file to contain the home directory, got %q", contents)
+	}
+
+	// a matching fingerprint skips detection
+	assertDir(t, "/detected/a", 1)
+
+	// a mismatching fingerprint runs detection and replaces the hint
+	patchEnv(t, "HOME", "b")
+	assertDir(t, "/detected/b", 2)
+	assertDir(t, "/detected/b", 2)
+
+	// a corrupt hint is ignored
+	if err := os.WriteFile(hint, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	assertDir(t, "/detected/b", 3)
+	assertDir(t, "/detected/b", 3)
+
+	// the hint is not used with caching disabled
+	SetCacheEnable(false)
+	assertDir(t, "/detected/b", 4)
+	SetCacheEnable(true)
+
+	// an empty path disables the persistent cache
+	EnablePersistentCache("")
+	assertDir(t, "/detected/b", 5)
+	assertDir(t, "/detected/b", 6)
+}
+
+func TestEnablePersistentCacheUnwritable(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(true)
+	ClearHomeDir()
+
+	original := detect
+	t.Cleanup(func() { detect = original })
+	detect = func() (string, error) { return "/detected", nil }
+
+	l := &recordingLogger{}
+	SetLogger(l)
+	EnablePersistentCache(filepath.Join(t.TempDir(), "missing", "home.hint"))
+
+	if actual, err := Dir(); err != nil || actual != "/detected" {
+		t.Errorf("Dir() = %q, want %q (err: %v)", actual, "/detected", err)
+	}
+	if len(l.messages) != 1 {
+		t.Errorf("expected a warning about the hint file, got %q", l.messages)
+	}
+}
+
+func TestPersistentCacheChecks(t *testing.T) {
+	restoreCache(t)
+	SetCacheEnable(true)
+	ClearHomeDir()
+	patchEnv(t, "HOME", "a")
+
+	original := detect
+	t.Cleanup(func() { detect = original })
+	attempts := 0
+	detect = func() (string, error) {
+		attempts++
+		return "/detected", nil
+	}
+
+	hint := filepath.Join(t.TempDir(), "home.hint")
+	EnablePersistentCache(hint)
+
+	// dir populates the hint (or reuses it) like a new process would
+	dir := func(t *testing.T) {
+		t.Helper()
+		Reset()
+		if actual, err := Dir(); err != nil || actual != "/detected" {
+			t.Errorf("Dir() = %q, want %q (err: %v)", actual, "/detected", err)
+		}
+	}
+	assertReused := func(t *testing.T, reused bool) {
+		t.Helper()
+		dir(t)
+		before := attempts
+		dir(t)
+		if (attempts == before) != reused {
+			t.Errorf("expected hint reused: %v, got %d detection attempts instead of %d", reused, attempts, before)
+		}
+	}
+
+	t.Run("validator", func(t *testing.T) {
+		reject := false
+		SetHomeValidator(func(string) error {
+			if reject {
+				return errors.New("rejected")
+			}
+			return nil
+		})
+		defer SetHomeValidator(nil)
+
+		assertReused(t, true)
+		reject = true
+		before := attempts
+		Reset()
+		_, _ = Dir()
+		if attempts != before+1 {
+			t.Errorf("expected a rejected hint to run detection, got %d attempts instead of %d", attempts, before+1)
+		}
+	})
+
+	t.Run("ignore env", func(t *testing.T) {
+		SetIgnoreEnv(true)
+		defer SetIgnoreEnv(false)
+		assertReused(t, false)
+	})
+
+	t.Run("settings are part of the fingerprint", func(t *testing.T) {
+		assertReused(t, true)
+		for _, change := range []func(bool){SetRespectSSHUser, SetLognameFallback} {
+			change(true)
+			before := attempts
+			dir(t)
+			if attempts != before+1 {
+				t.Errorf("expected a settings change to run detection, got %d attempts instead of %d", attempts, before+1)
+			}
+			change(false)
+			dir(t)
+		}
+		SetPrimaryEnvVar("HOMEDIR_TEST_HOME")
+		before := attempts
+		dir(t)
+		if attempts != before+1 {
+			t.Errorf("expected a primary env var change to run detection, got %d attempts instead of %d", attempts, before+1)
+		}
+		SetPrimaryEnvVar("")
+
+		passwd := filepath.Join(t.TempDir(), "passwd")
+		for _, tc := range []struct {
+			change, revert func()
+		}{
+			{func() { SetPasswdPath(passwd) }, func() { SetPasswdPath("") }},
+			{func() { SetHermeticFallback("/hermetic") }, ClearHermeticFallback},
+		} {
+			dir(t)
+			tc.change()
+			before := attempts
+			dir(t)
+			if attempts != before+1 {
+				t.Errorf("expected a settings change to run detection, got %d attempts instead of %d", attempts, before+1)
+			}
+			tc.revert()
+		}
+	})
+
+	t.Run("hermetic fallback is not persisted", func(t *testing.T) {
+		fallback := t.TempDir()
+		SetHermeticFallback(fallback)
+		defer ClearHermeticFallback()
+		detect = func() (string, error) {
+			attempts++
+			return fallback, nil
+		}
+		defer func() {
+			detect = func() (string, error) {
+				attempts++
+				return "/detected", nil
+			}
+		}()
+
+		for i := 0; i < 2; i++ {
+			before := attempts
+			Reset()
+			if actual, err := Dir(); err != nil || actual != fallback {
+				t.Errorf("Dir() = %q, want %q (err: %v)", actual, fallback, err)
+			}
+			if attempts != before+1 {
+				t.Errorf("expected the fallback to be detected again, got %d attempts instead of %d", attempts, before+1)
+			}
+		}
+	})
+
+	t.Run("writable by others", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("file permissions are not checked on windows")
+		}
+		assertReused(t, true)
+		if err := os.Chmod(hint, 0o666); err != nil {
+			t.Fatal(err)
+		}
+		before := attempts
+		dir(t)
+		if attempts != before+1 {
+			t.Errorf("expected a world-writable hint to be ignored, got %d attempts instead of %d", attempts, before+1)
+		}
+	})
+
+	t.Run("owned by another user", func(t *testing.T) {
+		if runtime.GOOS == "windows" || os.Geteuid() != 0 {
+			t.Skip("changing the owner requires root")
+		}
+		assertReused(t, true)
+		if err := os.Chown(hint, 12345, 12345); err != nil {
+			t.Fatal(err)
+		}
+		before := attempts
+		dir(t)
+		if attempts != before+1 {
+			t.Errorf("expected a hint owned by another user to be ignored, got %d attempts instead of %d", attempts, before+1)
+		}
+	})
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package homedir
+
+// runningAsLocalSystem always reports false, as LocalSystem only exists on Windows.
+func runningAsLocalSystem() bool {
+	return false
+}
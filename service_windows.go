@@ -0,0 +1,21 @@
+package homedir
+
+import "syscall"
+
+// localSystemSID is the well-known SID of the LocalSystem account.
+const localSystemSID = "S-1-5-18"
+
+func runningAsLocalSystem() bool {
+	token, err := syscall.OpenCurrentProcessToken()
+	if err != nil {
+		return false
+	}
+	defer token.Close()
+
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return false
+	}
+	sid, err := user.User.Sid.String()
+	return err == nil && sid == localSystemSID
+}
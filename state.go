@@ -0,0 +1,259 @@
+package homedir
+
+import (
+	"runtime"
+	"sort"
+)
+
+// State is an opaque snapshot of the package configuration and caches, as
+// captured by Snapshot and applied by Restore.
+type State struct {
+	cacheEnabled    bool
+	cacheErrors     bool
+	cacheRevalidate bool
+	respectSSHUser  bool
+	serviceProfile  bool
+	lognameFallback bool
+	ignoreEnv       bool
+	forceAbsolute   bool
+	driveRoot       bool
+	afterEquals     bool
+	userLookup      bool
+	maxPathLength   int64
+	unknownUser     int32
+	cache           cacheEntry
+	errCache        errCacheEntry
+	physicalCache   physicalCacheEntry
+	expandCache     expandCacheEntry
+	override        string
+	primaryEnvVar   string
+	dirStack        []string
+	validator       validatorEntry
+	logger          loggerEntry
+	statFS          statFSEntry
+	hermetic        hermeticEntry
+	registeredHomes map[string]string
+	userCacheSize   int
+	userCache       []lruEntry
+	expandSize      int
+	expandIntern    []lruEntry
+	expandEvict     evictFuncEntry
+	postProcessor   postProcessorEntry
+	passwdPath      string
+	appName         string
+	persistentCache string
+	platform        platformState
+}
+
+// Snapshot captures the current configuration (cache settings, overrides,
+// validators, ...) and caches, so they can be restored later with Restore.
+// This is useful for tests and plugins that need to change settings
+// temporarily.
+func Snapshot() State {
+	s := State{
+		cacheEnabled:    cacheEnabled.Load(),
+		cacheErrors:     cacheErrors.Load(),
+		cacheRevalidate: cacheRevalidate.Load(),
+		respectSSHUser:  respectSSHUser.Load(),
+		serviceProfile:  windowsServiceProfile.Load(),
+		lognameFallback: lognameFallback.Load(),
+		ignoreEnv:       ignoreEnv.Load(),
+		forceAbsolute:   forceAbsoluteHome.Load(),
+		driveRoot:       normalizeDriveRoot.Load(),
+		afterEquals:     expandAfterEquals.Load(),
+		userLookup:      expandUserLookup.Load(),
+		maxPathLength:   maxPathLength.Load(),
+		unknownUser:     unknownUserPolicy.Load(),
+		cache:           homedirCache.Load().(cacheEntry),
+		errCache:        homedirErrCache.Load().(errCacheEntry),
+		physicalCache:   physicalCache.Load().(physicalCacheEntry),
+		expandCache:     expandCache.Load().(expandCacheEntry),
+		override:        homedirOverride.Load().(string),
+		primaryEnvVar:   primaryEnvVar.Load().(string),
+		dirStack:        dirStack.Load().([]string),
+		validator:       homeValidator.Load().(validatorEntry),
+		logger:          logger.Load().(loggerEntry),
+		statFS:          statFS.Load().(statFSEntry),
+		hermetic:        hermeticFallback.Load().(hermeticEntry),
+		expandEvict:     expandEvictFunc.Load().(evictFuncEntry),
+		postProcessor:   expandPostProcessor.Load().(postProcessorEntry),
+		registeredHomes: registeredHomes.Load().(map[string]string),
+		passwdPath:      passwdPath.Load().(string),
+		appName:         appName.Load().(string),
+		persistentCache: persistentCachePath.Load().(string),
+		platform:        snapshotPlatform(),
+	}
+	s.userCacheSize, s.userCache = userCache.state()
+	s.expandSize, s.expandIntern = expandIntern.state()
+	return s
+}
+
+// Restore applies a State previously captured with Snapshot.
+func Restore(s State) {
+	cacheEnabled.Store(s.cacheEnabled)
+	cacheErrors.Store(s.cacheErrors)
+	cacheRevalidate.Store(s.cacheRevalidate)
+	respectSSHUser.Store(s.respectSSHUser)
+	windowsServiceProfile.Store(s.serviceProfile)
+	lognameFallback.Store(s.lognameFallback)
+	ignoreEnv.Store(s.ignoreEnv)
+	forceAbsoluteHome.Store(s.forceAbsolute)
+	normalizeDriveRoot.Store(s.driveRoot)
+	expandAfterEquals.Store(s.afterEquals)
+	expandUserLookup.Store(s.userLookup)
+	maxPathLength.Store(s.maxPathLength)
+	unknownUserPolicy.Store(s.unknownUser)
+	homedirCache.Store(s.cache)
+	homedirErrCache.Store(s.errCache)
+	physicalCache.Store(s.physicalCache)
+	expandCache.Store(s.expandCache)
+	homedirOverride.Store(s.override)
+	primaryEnvVar.Store(s.primaryEnvVar)
+	dirStack.Store(s.dirStack)
+	homeValidator.Store(s.validator)
+	logger.Store(s.logger)
+	statFS.Store(s.statFS)
+	hermeticFallback.Store(s.hermetic)
+	expandEvictFunc.Store(s.expandEvict)
+	expandPostProcessor.Store(s.postProcessor)
+	registeredHomes.Store(s.registeredHomes)
+	passwdPath.Store(s.passwdPath)
+	appName.Store(s.appName)
+	persistentCachePath.Store(s.persistentCache)
+	userCache.restore(s.userCacheSize, s.userCache)
+	expandIntern.restore(s.expandSize, s.expandIntern)
+	restorePlatform(s.platform)
+}
+
+// ConfigSnapshot describes the effective configuration of the package, as
+// reported by Config.
+type ConfigSnapshot struct {
+	// CacheEnabled reports whether caching is enabled (see SetCacheEnable).
+	CacheEnabled bool
+	// CacheErrors reports whether detection errors are cached (see SetCacheErrors).
+	CacheErrors bool
+	// CacheRevalidate reports whether the cache is revalidated against the
+	// environment (see SetCacheRevalidate).
+	CacheRevalidate bool
+	// UserCacheSize is the size limit of the per-user cache, 0 if unbounded
+	// (see SetUserCacheSize).
+	UserCacheSize int
+	// ExpandCacheSize is the number of additionally cached Expand results, 0
+	// if disabled (see SetExpandCacheSize).
+	ExpandCacheSize int
+	// MaxPathLength is the maximum length of expanded paths, 0 if unlimited
+	// (see SetMaxPathLength).
+	MaxPathLength int
+	// ForceAbsoluteHome reports whether a relative home directory is made
+	// absolute when expanding (see SetForceAbsoluteHome).
+	ForceAbsoluteHome bool
+	// WindowsNormalizeDriveRoot reports whether a drive-only home directory
+	// is expanded against the drive root (see SetWindowsNormalizeDriveRoot).
+	WindowsNormalizeDriveRoot bool
+	// ExpandAfterEquals reports whether `KEY=~/path` assignments are expanded
+	// (see SetExpandAfterEquals).
+	ExpandAfterEquals bool
+	// ExpandUserLookup reports whether `~user` paths are expanded by looking
+	// up arbitrary users (see SetExpandUserLookup).
+	ExpandUserLookup bool
+	// UnknownUserPolicy is the policy for unresolvable `~user` paths (see
+	// SetUnknownUserPolicy).
+	UnknownUserPolicy UnknownUserPolicy
+	// RespectSSHUser reports whether SSH_USER/LOGNAME is honored (see
+	// SetRespectSSHUser).
+	RespectSSHUser bool
+	// WindowsServiceProfileFallback reports whether the LocalSystem profile
+	// is used as a last resort on Windows (see SetWindowsServiceProfileFallback).
+	WindowsServiceProfileFallback bool
+	// IgnoreEnv reports whether detection ignores the environment (see
+	// SetIgnoreEnv).
+	IgnoreEnv bool
+	// LognameFallback reports whether the user named by LOGNAME or USER is
+	// looked up during detection (see SetLognameFallback).
+	LognameFallback bool
+	// PrimaryEnvVar is the environment variable consulted first during
+	// detection, empty if unset (see SetPrimaryEnvVar).
+	PrimaryEnvVar string
+	// HermeticFallback is the fallback home set via SetHermeticFallback,
+	// empty if unset.
+	HermeticFallback string
+	// Override is the path set via SetHomeDir, empty if unset.
+	Override string
+	// Frozen is the path frozen via Freeze, empty if not frozen.
+	Frozen string
+	// ValidatorSet reports whether a validator is set (see SetHomeValidator).
+	ValidatorSet bool
+	// LoggerSet reports whether a logger is set (see SetLogger).
+	LoggerSet bool
+	// PostProcessorSet reports whether a post-processor is set for Expand
+	// results (see SetExpandPostProcessor).
+	PostProcessorSet bool
+	// StatFSSet reports whether a file system is set for existence checks
+	// (see SetStatFS).
+	StatFSSet bool
+	// PasswdPath is the passwd file parsed when getent is unavailable (see
+	// SetPasswdPath).
+	PasswdPath string
+	// PersistentCache is the hint file set via EnablePersistentCache, empty
+	// if disabled.
+	PersistentCache string
+	// AppName is the application name set via SetAppName, empty if unset.
+	AppName string
+	// DirStack is the directory stack set via SetDirStack, nil if unset.
+	DirStack []string
+	// RegisteredHomes are the names registered via RegisterHome, sorted.
+	RegisteredHomes []string
+	// DetectionOrder lists the detection methods tried by Dir, in order.
+	DetectionOrder []Source
+}
+
+// Config reports the effective configuration of the package. Unlike Snapshot,
+// the result can be inspected, but not restored. It is safe to call
+// concurrently with the setters.
+func Config() ConfigSnapshot {
+	homes := registeredHomes.Load().(map[string]string)
+	names := make([]string, 0, len(homes))
+	for name := range homes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var order []Source
+	for _, s := range strategies(runtime.GOOS) {
+		order = append(order, s.source)
+	}
+
+	userCacheSize, _ := userCache.state()
+
+	return ConfigSnapshot{
+		CacheEnabled:                  caching(),
+		CacheErrors:                   cacheErrors.Load(),
+		CacheRevalidate:               cacheRevalidate.Load(),
+		UserCacheSize:                 userCacheSize,
+		ExpandCacheSize:               expandIntern.capacity(),
+		MaxPathLength:                 int(maxPathLength.Load()),
+		ForceAbsoluteHome:             forceAbsoluteHome.Load(),
+		ExpandAfterEquals:             expandAfterEquals.Load(),
+		ExpandUserLookup:              expandUserLookup.Load(),
+		UnknownUserPolicy:             UnknownUserPolicy(unknownUserPolicy.Load()),
+		RespectSSHUser:                respectSSHUser.Load(),
+		WindowsServiceProfileFallback: windowsServiceProfile.Load(),
+		WindowsNormalizeDriveRoot:     normalizeDriveRoot.Load(),
+		LognameFallback:               lognameFallback.Load(),
+		IgnoreEnv:                     ignoreEnv.Load(),
+		PrimaryEnvVar:                 primaryEnvVar.Load().(string),
+		HermeticFallback:              hermeticFallback.Load().(hermeticEntry).dir,
+		Override:                      homedirOverride.Load().(string),
+		Frozen:                        frozenHome.Load().(string),
+		ValidatorSet:                  homeValidator.Load().(validatorEntry).validate != nil,
+		LoggerSet:                     logger.Load().(loggerEntry).logger != nil,
+		PostProcessorSet:              expandPostProcessor.Load().(postProcessorEntry).process != nil,
+		StatFSSet:                     statFS.Load().(statFSEntry).fsys != nil,
+		PasswdPath:                    passwdPath.Load().(string),
+		PersistentCache:               persistentCachePath.Load().(string),
+		AppName:                       appName.Load().(string),
+		DirStack:                      append([]string(nil), dirStack.Load().([]string)...),
+		RegisteredHomes:               names,
+		DetectionOrder:                order,
+	}
+}
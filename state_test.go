@@ -0,0 +1,131 @@
+package homedir
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	restoreCache(t)
+
+	SetCacheEnable(true)
+	SetCacheErrors(false)
+	SetCacheRevalidate(false)
+	SetRespectSSHUser(false)
+	SetHomeValidator(nil)
+	ClearHomeDir()
+	Reset()
+
+	before, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	state := Snapshot()
+
+	// mutate several settings
+	SetCacheEnable(false)
+	SetCacheErrors(true)
+	SetCacheRevalidate(true)
+	SetRespectSSHUser(true)
+	SetHomeDir("/snapshot/override")
+	errRejected := errors.New("rejected")
+	SetHomeValidator(func(string) error { return errRejected })
+
+	if dir, err := Dir(); err != nil || dir != "/snapshot/override" {
+		t.Fatalf("expected override to be in effect, got %q (err: %v)", dir, err)
+	}
+
+	Restore(state)
+
+	if !CacheEnabled() {
+		t.Error("expected cache to be enabled after restore")
+	}
+	if cacheErrors.Load() || cacheRevalidate.Load() || respectSSHUser.Load() {
+		t.Error("expected cache errors, revalidation and SSH user to be disabled after restore")
+	}
+	if homeValidator.Load().(validatorEntry).validate != nil {
+		t.Error("expected validator to be cleared after restore")
+	}
+	if cached := homedirCache.Load().(cacheEntry); cached.dir != before {
+		t.Errorf("expected cached home %q after restore, got %q", before, cached.dir)
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed after restore: %s", err)
+	}
+	if dir != before {
+		t.Errorf("expected %q after restore, got %q", before, dir)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	restoreCache(t)
+
+	SetCacheEnable(false)
+	SetCacheErrors(true)
+	SetCacheRevalidate(true)
+	SetUserCacheSize(16)
+	SetMaxPathLength(4096)
+	SetUnknownUserPolicy(UnknownUserPassthroughWithWarn)
+	SetRespectSSHUser(true)
+	SetWindowsNormalizeDriveRoot(true)
+	SetHomeDir("/config/override")
+	SetHermeticFallback("/config/hermetic")
+	SetHomeValidator(func(string) error { return nil })
+	SetLogger(&recordingLogger{})
+	SetExpandPostProcessor(strings.ToLower)
+	SetPasswdPath("/config/passwd")
+	RegisterHome("team", "/srv/team")
+	RegisterHome("shared", "/srv/shared")
+	EnablePersistentCache("/config/home.hint")
+	if err := SetAppName("config-app"); err != nil {
+		t.Fatalf("SetAppName() failed: %s", err)
+	}
+
+	config := Config()
+
+	if config.CacheEnabled || !config.CacheErrors || !config.CacheRevalidate {
+		t.Errorf("unexpected cache settings: %+v", config)
+	}
+	if config.UserCacheSize != 16 || config.MaxPathLength != 4096 {
+		t.Errorf("unexpected limits: %+v", config)
+	}
+	if config.UnknownUserPolicy != UnknownUserPassthroughWithWarn || !config.RespectSSHUser {
+		t.Errorf("unexpected user settings: %+v", config)
+	}
+	if !config.WindowsNormalizeDriveRoot {
+		t.Errorf("expected drive root normalization to be reported as enabled: %+v", config)
+	}
+	if config.Override != "/config/override" || config.Frozen != "" || config.HermeticFallback != "/config/hermetic" {
+		t.Errorf("unexpected overrides: %+v", config)
+	}
+	if !config.ValidatorSet || !config.LoggerSet || !config.PostProcessorSet {
+		t.Errorf("expected validator, logger and post-processor to be reported as set: %+v", config)
+	}
+	if config.PasswdPath != "/config/passwd" {
+		t.Errorf("expected passwd path %q, got %q", "/config/passwd", config.PasswdPath)
+	}
+	if config.PersistentCache != "/config/home.hint" {
+		t.Errorf("expected persistent cache %q, got %q", "/config/home.hint", config.PersistentCache)
+	}
+	if config.AppName != "config-app" {
+		t.Errorf("expected app name %q, got %q", "config-app", config.AppName)
+	}
+	if expected := []string{"shared", "team"}; !reflect.DeepEqual(config.RegisteredHomes, expected) {
+		t.Errorf("expected registered homes %v, got %v", expected, config.RegisteredHomes)
+	}
+	if len(config.DetectionOrder) == 0 || config.DetectionOrder[0] != SourceSSHUser {
+		t.Errorf("expected detection order starting with %s, got %v", SourceSSHUser, config.DetectionOrder)
+	}
+
+	SetHomeValidator(nil)
+	SetLogger(nil)
+	SetExpandPostProcessor(nil)
+	if config := Config(); config.ValidatorSet || config.LoggerSet || config.PostProcessorSet {
+		t.Errorf("expected validator, logger and post-processor to be reported as unset: %+v", config)
+	}
+}
@@ -0,0 +1,385 @@
+package homedir
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// respectSSHUser controls whether the user named by SSH_USER/LOGNAME takes precedence (disabled by default).
+var respectSSHUser atomic.Bool
+
+// registeredHomes stores the named homes added via RegisterHome (a map[string]string, replaced on every change)
+var registeredHomes atomic.Value
+
+// registeredHomesMu serializes changes to registeredHomes.
+var registeredHomesMu sync.Mutex
+
+// defaultPasswdPath is the passwd file consulted when getent is unavailable.
+const defaultPasswdPath = "/etc/passwd"
+
+// passwdPath stores the passwd file consulted when getent is unavailable
+var passwdPath atomic.Value
+
+func init() {
+	registeredHomes.Store(map[string]string{})
+	passwdPath.Store(defaultPasswdPath)
+}
+
+// UnknownUserPolicy controls how Expand handles a `~user` path when the home
+// directory of the user cannot be resolved.
+type UnknownUserPolicy int
+
+const (
+	// UnknownUserError makes Expand return an error (the default).
+	UnknownUserError UnknownUserPolicy = iota
+	// UnknownUserPassthrough makes Expand return the path unchanged.
+	UnknownUserPassthrough
+	// UnknownUserPassthroughWithWarn makes Expand return the path unchanged
+	// and log a warning (see SetLogger).
+	UnknownUserPassthroughWithWarn
+)
+
+// unknownUserPolicy stores the policy set via SetUnknownUserPolicy
+var unknownUserPolicy atomic.Int32
+
+// ErrUnknownUser is returned (wrapped) when a user cannot be found, e.g. by
+// DirFor or when expanding a `~user` path.
+var ErrUnknownUser = errors.New("unknown user")
+
+// passwdEntry is the subset of a passwd database entry used by this package.
+type passwdEntry struct {
+	name string
+	uid  string
+	home string
+}
+
+// lookupUser looks up a user by name or uid (swapped out in tests).
+var lookupUser = lookupPasswd
+
+// userCache caches the home directories resolved by DirFor and DirForUID, keyed by username or uid.
+var userCache = newLRUCache()
+
+// SetUserCacheSize limits the number of home directories cached by DirFor and
+// DirForUID, evicting the least recently used ones once the limit is reached.
+// A size of 0 (the default) leaves the cache unbounded. Like the home
+// directory cache, the per-user cache is only used when caching is enabled
+// (see SetCacheEnable) and is cleared by Reset.
+func SetUserCacheSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	userCache.resize(size)
+}
+
+// ResetUser removes the home directory of the user with the given username
+// from the per-user cache (see SetUserCacheSize), so that the next call to
+// DirFor (or expansion of a `~user` path) looks it up again, e.g. after the
+// account has been provisioned or changed. Unlike Reset, all other cached
+// entries are kept. An entry cached for the same user by uid is not affected
+// (see ResetUID).
+func ResetUser(username string) {
+	userCache.remove(username)
+}
+
+// ResetUID is like ResetUser, but removes the home directory cached for the
+// user with the given uid (see DirForUID).
+func ResetUID(uid int) {
+	userCache.remove(strconv.Itoa(uid))
+}
+
+// lookupHome returns the home directory of the user with the given username
+// or uid, consulting the per-user cache first.
+func lookupHome(key string) (string, error) {
+	if caching() {
+		if home, ok := userCache.get(key); ok {
+			return home, nil
+		}
+	}
+	entry, err := lookupUser(key)
+	if err != nil {
+		return "", err
+	}
+	if caching() {
+		userCache.add(key, entry.home)
+	}
+	return entry.home, nil
+}
+
+// DirFor returns the home directory of the user with the given username.
+//
+// Like the rest of this package, this does not use the os/user package.
+// Instead, the user is looked up via getent (or dscl on macOS). Looking up
+// other users is not supported on Windows.
+func DirFor(username string) (string, error) {
+	if username == "" {
+		return "", errors.New("username must not be empty")
+	}
+	return lookupHome(username)
+}
+
+// DirForUID returns the home directory of the user with the given uid. See
+// DirFor for how the user is looked up.
+func DirForUID(uid int) (string, error) {
+	if uid < 0 {
+		return "", fmt.Errorf("invalid uid %d", uid)
+	}
+	return lookupHome(strconv.Itoa(uid))
+}
+
+// RegisterHome adds a named home directory that is used to expand `~name`
+// paths, taking precedence over looking up a user with that name. This lets
+// applications define virtual users (e.g. a shared `~shared` home) without
+// real accounts. Registering a name again replaces its path.
+func RegisterHome(name, path string) {
+	updateRegisteredHomes(func(homes map[string]string) {
+		homes[name] = path
+	})
+}
+
+// UnregisterHome removes a named home directory added via RegisterHome.
+func UnregisterHome(name string) {
+	updateRegisteredHomes(func(homes map[string]string) {
+		delete(homes, name)
+	})
+}
+
+// SetUserHomes replaces all named home directories (see RegisterHome) with
+// the given username to home directory map, which makes the expansion of
+// `~user` paths deterministic in tests without real accounts. Names absent
+// from the map are looked up as usual (see DirFor). A nil or empty map
+// removes all named home directories. The map is copied, so later changes to
+// it have no effect.
+func SetUserHomes(homes map[string]string) {
+	updateRegisteredHomes(func(current map[string]string) {
+		for name := range current {
+			delete(current, name)
+		}
+		for name, path := range homes {
+			current[name] = path
+		}
+	})
+}
+
+func registeredHome(name string) (string, bool) {
+	home, ok := registeredHomes.Load().(map[string]string)[name]
+	return home, ok
+}
+
+func updateRegisteredHomes(update func(homes map[string]string)) {
+	registeredHomesMu.Lock()
+	defer registeredHomesMu.Unlock()
+
+	current := registeredHomes.Load().(map[string]string)
+	homes := make(map[string]string, len(current)+1)
+	for name, path := range current {
+		homes[name] = path
+	}
+	update(homes)
+	registeredHomes.Store(homes)
+}
+
+// SetUnknownUserPolicy controls how Expand handles `~user` paths for users
+// that do not exist or cannot be looked up because user lookups are disabled
+// (see ErrUnknownUser and SetExpandUserLookup), ranging from strict
+// (UnknownUserError, the default) to forgiving (UnknownUserPassthrough) for
+// lenient config loaders. Other failures, such as a malformed prefix or a
+// failing lookup, are always returned as errors.
+func SetUnknownUserPolicy(policy UnknownUserPolicy) {
+	unknownUserPolicy.Store(int32(policy))
+}
+
+func unknownUser(path, username string, err error) (ExpandResult, error) {
+	if !errors.Is(err, ErrUnknownUser) {
+		return ExpandResult{}, err
+	}
+	switch UnknownUserPolicy(unknownUserPolicy.Load()) {
+	case UnknownUserPassthrough:
+		return ExpandResult{Path: path, Tilde: true, User: username}, nil
+	case UnknownUserPassthroughWithWarn:
+		warnf("homedir: leaving %q unexpanded: %v", path, err)
+		return ExpandResult{Path: path, Tilde: true, User: username}, nil
+	}
+	return ExpandResult{}, err
+}
+
+// SetPasswdPath sets the passwd file that is parsed when getent is not
+// available (on platforms other than macOS and Windows). This is mainly useful
+// for tests, to make the fallback deterministic without a real account.
+// An empty path restores the default, /etc/passwd. Changing the path clears
+// the cache (see Reset).
+func SetPasswdPath(path string) {
+	if path == "" {
+		path = defaultPasswdPath
+	}
+	passwdPath.Store(path)
+	Reset()
+}
+
+// HomeDirOf returns the home directory of the user identified by id, which is
+// treated as a uid if it is all-numeric (see DirForUID) and as a username
+// otherwise (see DirFor). An empty id returns the home directory of the
+// executing user (see Dir).
+func HomeDirOf(id string) (string, error) {
+	if id == "" {
+		return Dir()
+	}
+	if uid, err := strconv.Atoi(id); err == nil && uid >= 0 && strings.Trim(id, "0123456789") == "" {
+		return DirForUID(uid)
+	}
+	return DirFor(id)
+}
+
+// SetRespectSSHUser controls whether detection honors the user named by the
+// SSH_USER (or, if unset, LOGNAME) environment variable. When enabled and that
+// user differs from the user running the process (as in forced-command SSH
+// setups), the home directory of the named user is used. If neither variable
+// is set or the user cannot be looked up, detection continues as usual.
+// By default, this is disabled. Changing this setting clears the cache (see Reset).
+func SetRespectSSHUser(enable bool) {
+	respectSSHUser.Store(enable)
+	Reset()
+}
+
+func sshUserHome() (string, error) {
+	if !respectSSHUser.Load() {
+		return "", nil
+	}
+
+	name := os.Getenv("SSH_USER")
+	if name == "" {
+		name = os.Getenv("LOGNAME")
+	}
+	if name == "" {
+		return "", nil
+	}
+
+	if current, err := lookupUser(strconv.Itoa(os.Getuid())); err == nil && current.name == name {
+		// not a different user, the usual detection applies
+		return "", nil
+	}
+
+	entry, err := lookupUser(name)
+	if err != nil {
+		// not fatal, fall back to the usual detection
+		return "", nil
+	}
+	return entry.home, nil
+}
+
+// lookupPasswd looks up a user by name or uid using OS-specific tooling.
+func lookupPasswd(key string) (passwdEntry, error) {
+	switch runtime.GOOS {
+	case "windows", "plan9":
+		return passwdEntry{}, fmt.Errorf("looking up users is not supported on %s", runtime.GOOS)
+	case "darwin":
+		return dsclLookup(key)
+	}
+	return getentLookup(key)
+}
+
+// checkLookupKey rejects keys that the lookup tools would parse as options,
+// such as `--service=files`, which makes getent list the whole database.
+func checkLookupKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "-") {
+		return fmt.Errorf("%w %q", ErrUnknownUser, key)
+	}
+	return nil
+}
+
+func getentLookup(key string) (passwdEntry, error) {
+	if err := checkLookupKey(key); err != nil {
+		return passwdEntry{}, err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("getent", "passwd", key) //nolint:gosec
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return lookupPasswdFile(key)
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			// getent exits with 2 when the key is not found in the database
+			return passwdEntry{}, fmt.Errorf("%w %q", ErrUnknownUser, key)
+		}
+		return passwdEntry{}, err
+	}
+
+	entry, ok := parsePasswdLine(stdout.String())
+	if !ok {
+		return passwdEntry{}, fmt.Errorf("no home directory for user %q", key)
+	}
+	if entry.name != key && entry.uid != key {
+		return passwdEntry{}, fmt.Errorf("getent returned an entry for %q instead of %q", entry.name, key)
+	}
+	return entry, nil
+}
+
+// lookupPasswdFile looks up a user by name or uid in the passwd file (see SetPasswdPath).
+func lookupPasswdFile(key string) (passwdEntry, error) {
+	contents, err := os.ReadFile(passwdPath.Load().(string))
+	if err != nil {
+		return passwdEntry{}, err
+	}
+
+	// like getent, an all-numeric key is a uid
+	byUID := strings.Trim(key, "0123456789") == ""
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, ok := parsePasswdLine(line)
+		if !ok {
+			continue
+		}
+		if (byUID && entry.uid == key) || (!byUID && entry.name == key) {
+			return entry, nil
+		}
+	}
+	return passwdEntry{}, fmt.Errorf("%w %q", ErrUnknownUser, key)
+}
+
+// parsePasswdLine parses a single passwd entry, reporting whether it has a home directory.
+func parsePasswdLine(line string) (passwdEntry, bool) {
+	// username:password:uid:gid:gecos:home:shell
+	passwdParts := strings.SplitN(strings.TrimSpace(line), ":", 7)
+	if len(passwdParts) < 6 || passwdParts[5] == "" {
+		return passwdEntry{}, false
+	}
+	return passwdEntry{name: passwdParts[0], uid: passwdParts[2], home: passwdParts[5]}, true
+}
+
+func dsclLookup(key string) (passwdEntry, error) {
+	if err := checkLookupKey(key); err != nil {
+		return passwdEntry{}, err
+	}
+
+	var stdout bytes.Buffer
+	// the key is passed as a positional argument to avoid any shell interpretation
+	script := `name="$(id -nu -- "$1")" && id -u -- "$1" && echo "$name" && dscl -q . -read /Users/"$name" NFSHomeDirectory | sed 's/^[^ ]*: //'`
+	cmd := exec.Command("sh", "-c", script, "sh", key)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return passwdEntry{}, fmt.Errorf("%w %q", ErrUnknownUser, key)
+	}
+
+	// uid, name, home
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) < 3 || strings.TrimSpace(lines[2]) == "" {
+		return passwdEntry{}, fmt.Errorf("no home directory for user %q", key)
+	}
+	return passwdEntry{
+		uid:  strings.TrimSpace(lines[0]),
+		name: strings.TrimSpace(lines[1]),
+		home: strings.TrimSpace(lines[2]),
+	}, nil
+}
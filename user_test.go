@@ -0,0 +1,1081 @@
+package homedir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubLookupUser replaces the user lookup with one backed by the given entries for the duration of the test
+func stubLookupUser(t testing.TB, entries ...passwdEntry) {
+	t.Helper()
+	original := lookupUser
+	originalLookup := expandUserLookup.Load()
+	userCache.clear()
+	expandUserLookup.Store(true)
+
+	lookupUser = func(key string) (passwdEntry, error) {
+		for _, entry := range entries {
+			if entry.name == key || entry.uid == key {
+				return entry, nil
+			}
+		}
+		return passwdEntry{}, fmt.Errorf("%w %q", ErrUnknownUser, key)
+	}
+
+	t.Cleanup(func() {
+		lookupUser = original
+		expandUserLookup.Store(originalLookup)
+		userCache.clear()
+	})
+}
+
+func TestDirFor(t *testing.T) {
+	stubLookupUser(t,
+		passwdEntry{name: "alice", uid: "1000", home: "/home/alice"},
+		passwdEntry{name: "bob", uid: "1001", home: "/home/bob"},
+	)
+
+	tests := []struct {
+		name        string
+		username    string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "known user",
+			username: "alice",
+			expected: "/home/alice",
+		},
+		{
+			name:        "unknown user",
+			username:    "mallory",
+			expectError: true,
+		},
+		{
+			name:        "empty username",
+			username:    "",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := DirFor(tc.username)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("DirFor(%q) error: got %v, want error: %v", tc.username, err, tc.expectError)
+			}
+			if dir != tc.expected {
+				t.Errorf("DirFor(%q) = %q, want %q", tc.username, dir, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDirForUID(t *testing.T) {
+	stubLookupUser(t, passwdEntry{name: "bob", uid: "1001", home: "/home/bob"})
+
+	tests := []struct {
+		name        string
+		uid         int
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "known uid",
+			uid:      1001,
+			expected: "/home/bob",
+		},
+		{
+			name:        "unknown uid",
+			uid:         4242,
+			expectError: true,
+		},
+		{
+			name:        "negative uid",
+			uid:         -1,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := DirForUID(tc.uid)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("DirForUID(%d) error: got %v, want error: %v", tc.uid, err, tc.expectError)
+			}
+			if dir != tc.expected {
+				t.Errorf("DirForUID(%d) = %q, want %q", tc.uid, dir, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSetUserCacheSize(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t,
+		passwdEntry{name: "alice", uid: "1000", home: "/home/alice"},
+		passwdEntry{name: "bob", uid: "1001", home: "/home/bob"},
+		passwdEntry{name: "carol", uid: "1002", home: "/home/carol"},
+	)
+
+	stubbed := lookupUser
+	var lookups []string
+	lookupUser = func(key string) (passwdEntry, error) {
+		lookups = append(lookups, key)
+		return stubbed(key)
+	}
+
+	SetCacheEnable(true)
+	SetUserCacheSize(2)
+
+	for _, username := range []string{"alice", "bob", "alice", "carol"} {
+		if _, err := DirFor(username); err != nil {
+			t.Fatalf("DirFor(%q) failed: %s", username, err)
+		}
+	}
+	// alice was used more recently than bob, so bob is evicted when carol is added
+	if _, ok := userCache.get("bob"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if _, ok := userCache.get("alice"); !ok {
+		t.Error("expected recently used entry to be kept")
+	}
+
+	expected := []string{"alice", "bob", "carol"}
+	if !reflect.DeepEqual(lookups, expected) {
+		t.Errorf("expected lookups %v, got %v", expected, lookups)
+	}
+
+	if home, err := DirFor("bob"); err != nil || home != "/home/bob" {
+		t.Errorf("expected %q after eviction, got %q (err: %v)", "/home/bob", home, err)
+	}
+	if len(lookups) != 4 {
+		t.Errorf("expected evicted entry to be looked up again, got lookups %v", lookups)
+	}
+
+	SetUserCacheSize(0)
+	for _, uid := range []int{1000, 1001, 1002} {
+		if _, err := DirForUID(uid); err != nil {
+			t.Fatalf("DirForUID(%d) failed: %s", uid, err)
+		}
+	}
+	if size, entries := userCache.state(); size != 0 || len(entries) != 5 {
+		t.Errorf("expected unbounded cache with 5 entries, got size %d with %d entries", size, len(entries))
+	}
+}
+
+func TestResetUser(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t,
+		passwdEntry{name: "alice", uid: "1000", home: "/home/alice"},
+		passwdEntry{name: "bob", uid: "1001", home: "/home/bob"},
+	)
+	SetCacheEnable(true)
+
+	for _, username := range []string{"alice", "bob"} {
+		if _, err := DirFor(username); err != nil {
+			t.Fatalf("DirFor(%q) failed: %s", username, err)
+		}
+	}
+	for _, uid := range []int{1000, 1001} {
+		if _, err := DirForUID(uid); err != nil {
+			t.Fatalf("DirForUID(%d) failed: %s", uid, err)
+		}
+	}
+
+	assertCached := func(t *testing.T, expected map[string]bool) {
+		t.Helper()
+		for key, cached := range expected {
+			if _, ok := userCache.get(key); ok != cached {
+				t.Errorf("expected %q to be cached: %v, got %v", key, cached, ok)
+			}
+		}
+	}
+	assertCached(t, map[string]bool{"alice": true, "bob": true, "1000": true, "1001": true})
+
+	ResetUser("alice")
+	assertCached(t, map[string]bool{"alice": false, "bob": true, "1000": true, "1001": true})
+
+	ResetUID(1001)
+	assertCached(t, map[string]bool{"alice": false, "bob": true, "1000": true, "1001": false})
+
+	// resetting an entry that is not cached is a no-op
+	ResetUser("mallory")
+	ResetUID(9999)
+	assertCached(t, map[string]bool{"bob": true, "1000": true})
+
+	// only the reset user is looked up again
+	stubbed := lookupUser
+	var lookups []string
+	lookupUser = func(key string) (passwdEntry, error) {
+		lookups = append(lookups, key)
+		return stubbed(key)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if _, err := DirFor(username); err != nil {
+			t.Fatalf("DirFor(%q) failed: %s", username, err)
+		}
+	}
+	if expected := []string{"alice"}; !reflect.DeepEqual(lookups, expected) {
+		t.Errorf("expected lookups %v, got %v", expected, lookups)
+	}
+}
+
+func TestHomeDirOf(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t,
+		passwdEntry{name: "alice", uid: "1000", home: "/home/alice"},
+		passwdEntry{name: "bob", uid: "1001", home: "/home/bob"},
+	)
+
+	home, err := Dir()
+	if err != nil {
+		t.Fatalf("Dir() failed: %s", err)
+	}
+
+	tests := []struct {
+		name        string
+		id          string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "username",
+			id:       "alice",
+			expected: "/home/alice",
+		},
+		{
+			name:     "uid",
+			id:       "1000",
+			expected: "/home/alice",
+		},
+		{
+			name:     "empty id",
+			id:       "",
+			expected: home,
+		},
+		{
+			name:        "unknown username",
+			id:          "mallory",
+			expectError: true,
+		},
+		{
+			name:        "signed id is treated as a username",
+			id:          "+1000",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := HomeDirOf(tc.id)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("HomeDirOf(%q) error: got %v, want error: %v", tc.id, err, tc.expectError)
+			}
+			if dir != tc.expected {
+				t.Errorf("HomeDirOf(%q) = %q, want %q", tc.id, dir, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRegisterHome(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t,
+		passwdEntry{name: "alice", uid: "1000", home: "/home/alice"},
+		passwdEntry{name: "shared", uid: "1001", home: "/home/shared-account"},
+	)
+
+	RegisterHome("shared", "/srv/shared")
+	RegisterHome("team", "/srv/team")
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "registered name takes precedence over passwd",
+			input:  "~shared/x",
+			output: filepath.Join("/srv/shared", "x"),
+		},
+		{
+			name:   "registered name without an account",
+			input:  "~team",
+			output: "/srv/team",
+		},
+		{
+			name:   "passwd fallback",
+			input:  "~alice/x",
+			output: filepath.Join("/home/alice", "x"),
+		},
+		{
+			name:  "unknown name",
+			input: "~mallory/x",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := Expand(tc.input)
+			if (err != nil) != tc.err {
+				t.Fatalf("Expand(%q) error: got %v, want error: %v", tc.input, err, tc.err)
+			}
+			if actual != tc.output {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	t.Run("unregistered name falls back to passwd", func(t *testing.T) {
+		UnregisterHome("shared")
+		actual, err := Expand("~shared/x")
+		if err != nil {
+			t.Fatalf("Expand() failed: %s", err)
+		}
+		if want := filepath.Join("/home/shared-account", "x"); actual != want {
+			t.Errorf("expected %q, got %q", want, actual)
+		}
+	})
+}
+
+func TestSetUserHomes(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1000", home: "/home/alice"})
+
+	RegisterHome("old", "/srv/old")
+	homes := map[string]string{
+		"bob":   "/test/bob",
+		"alice": "/test/alice",
+	}
+	SetUserHomes(homes)
+	homes["carol"] = "/test/carol" // copied, so not picked up
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		err    bool
+	}{
+		{
+			name:   "user from the map",
+			input:  "~bob/x",
+			output: filepath.Join("/test/bob", "x"),
+		},
+		{
+			name:   "map takes precedence over passwd",
+			input:  "~alice/x",
+			output: filepath.Join("/test/alice", "x"),
+		},
+		{
+			name:  "previously registered names are replaced",
+			input: "~old/x",
+			err:   true,
+		},
+		{
+			name:  "later changes to the map are ignored",
+			input: "~carol/x",
+			err:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := Expand(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Errorf("Expand(%q) = %q, want error", tc.input, actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expand(%q) failed: %s", tc.input, err)
+			}
+			if actual != tc.output {
+				t.Errorf("Expand(%q) = %q, want %q", tc.input, actual, tc.output)
+			}
+		})
+	}
+
+	// users absent from the map fall back to the passwd lookup
+	SetUserHomes(nil)
+	if actual, err := Expand("~alice/x"); err != nil || actual != filepath.Join("/home/alice", "x") {
+		t.Errorf("Expand(%q) = %q, want %q (err: %v)", "~alice/x", actual, filepath.Join("/home/alice", "x"), err)
+	}
+	if _, err := Expand("~bob/x"); err == nil {
+		t.Error("expected an error after clearing the map")
+	}
+}
+
+func TestSetExpandUserLookup(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1000", home: "/home/alice"})
+	RegisterHome("team", "/srv/team")
+
+	SetExpandUserLookup(false)
+	if _, err := Expand("~alice/x"); !errors.Is(err, ErrUserLookupDisabled) || !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("expected ErrUserLookupDisabled and ErrUnknownUser, got %v", err)
+	}
+	SetUnknownUserPolicy(UnknownUserPassthrough)
+	if actual, err := Expand("~alice/x"); err != nil || actual != "~alice/x" {
+		t.Errorf("expected the unknown user policy to apply, got %q (err: %v)", actual, err)
+	}
+	SetUnknownUserPolicy(UnknownUserError)
+	if actual, err := Expand("~team/x"); err != nil || actual != filepath.Join("/srv/team", "x") {
+		t.Errorf("Expand(%q) = %q, want %q (err: %v)", "~team/x", actual, filepath.Join("/srv/team", "x"), err)
+	}
+	if Config().ExpandUserLookup {
+		t.Error("expected Config() to report user lookup as disabled")
+	}
+
+	SetExpandUserLookup(true)
+	if actual, err := Expand("~alice/x"); err != nil || actual != filepath.Join("/home/alice", "x") {
+		t.Errorf("Expand(%q) = %q, want %q (err: %v)", "~alice/x", actual, filepath.Join("/home/alice", "x"), err)
+	}
+	if !Config().ExpandUserLookup {
+		t.Error("expected Config() to report user lookup as enabled")
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1000", home: "/home/alice"})
+	SetUnknownUserPolicy(UnknownUserError)
+
+	t.Run("unknown user", func(t *testing.T) {
+		input := "~mallory/x"
+		_, err := Expand(input)
+		if err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+		if !errors.Is(err, ErrUnknownUser) {
+			t.Errorf("expected %v to wrap ErrUnknownUser", err)
+		}
+		if !strings.Contains(err.Error(), strconv.Quote(input)) {
+			t.Errorf("expected %q to contain the input %q", err, input)
+		}
+	})
+
+	t.Run("detection failure", func(t *testing.T) {
+		original := detect
+		t.Cleanup(func() { detect = original })
+		detectErr := errors.New("no home")
+		detect = func() (string, error) { return "", detectErr }
+		ClearHomeDir()
+		Reset()
+
+		input := "~/x"
+		_, err := Expand(input)
+		if !errors.Is(err, detectErr) {
+			t.Fatalf("expected %v to wrap %v", err, detectErr)
+		}
+		if !strings.Contains(err.Error(), strconv.Quote(input)) {
+			t.Errorf("expected %q to contain the input %q", err, input)
+		}
+	})
+
+	t.Run("path too long", func(t *testing.T) {
+		SetHomeDir("/home/alice")
+		SetMaxPathLength(8)
+
+		input := "~/some/long/path"
+		_, err := Expand(input)
+		if err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+		if !strings.Contains(err.Error(), strconv.Quote(input)) {
+			t.Errorf("expected %q to contain the input %q", err, input)
+		}
+	})
+
+	if _, err := DirFor("mallory"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("expected DirFor error %v to wrap ErrUnknownUser", err)
+	}
+}
+
+func TestExpandErrorClassification(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1000", home: "/home/alice"})
+	SetUnknownUserPolicy(UnknownUserError)
+	ClearHomeDir()
+	Reset()
+
+	original := detect
+	t.Cleanup(func() { detect = original })
+	detect = func() (string, error) {
+		dir, _, err := runStrategies("linux", []strategy{
+			{SourceEnv, func() (string, error) { return "", nil }},
+			{SourceShell, func() (string, error) { return "", errors.New("exit status 2") }},
+		})
+		return dir, err
+	}
+
+	sentinels := []error{ErrNoHomeDir, ErrUnknownUser, ErrBadTilde}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected error
+	}{
+		{
+			name:     "no home",
+			input:    "~/x",
+			expected: ErrNoHomeDir,
+		},
+		{
+			name:     "unknown user",
+			input:    "~mallory/x",
+			expected: ErrUnknownUser,
+		},
+		{
+			name:     "whitespace in username",
+			input:    "~my user/x",
+			expected: ErrBadTilde,
+		},
+		{
+			name:     "colon in username",
+			input:    "~a:b",
+			expected: ErrBadTilde,
+		},
+		{
+			name:     "double tilde",
+			input:    "~~/x",
+			expected: ErrBadTilde,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Expand(tc.input)
+			for _, sentinel := range sentinels {
+				if errors.Is(err, sentinel) != (sentinel == tc.expected) {
+					t.Errorf("Expand(%q) error %v: want only %v, but errors.Is(%v) differs", tc.input, err, tc.expected, sentinel)
+				}
+			}
+		})
+	}
+
+	if _, err := Expand("~alice/x"); err != nil {
+		t.Errorf("expected a known user to expand without a home directory, got %v", err)
+	}
+}
+
+func TestExpandContext(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/me")
+	SetExpandUserLookup(true)
+
+	original := lookupUser
+	release := make(chan struct{})
+	returned := make(chan struct{}, 2)
+	lookupUser = func(key string) (passwdEntry, error) {
+		defer func() { returned <- struct{}{} }()
+		<-release
+		return passwdEntry{name: key, uid: "1000", home: "/home/" + key}, nil
+	}
+	t.Cleanup(func() {
+		lookupUser = original
+	})
+	userCache.clear()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err := ExpandContext(ctx, "~slow/x")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// the current user's home does not require a (blocking) lookup
+	quick, cancelQuick := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelQuick()
+	actual, err := ExpandContext(quick, "~/x")
+	if err != nil {
+		t.Fatalf("ExpandContext() failed: %s", err)
+	}
+	if expected := filepath.Join("/home/me", "x"); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+
+	if actual, err := ExpandContext(ctx, "/no/tilde"); err != nil || actual != "/no/tilde" {
+		t.Errorf("expected path as-is, got %q (err: %v)", actual, err)
+	}
+
+	// let the background lookup complete before restoring the stub
+	close(release)
+	<-returned
+
+	actual, err = ExpandContext(context.Background(), "~slow/x")
+	if err != nil {
+		t.Fatalf("ExpandContext() failed: %s", err)
+	}
+	if expected := filepath.Join("/home/slow", "x"); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestWithHome(t *testing.T) {
+	restoreCache(t)
+	SetHomeDir("/home/global")
+	stubLookupUser(t, passwdEntry{name: "alice", uid: "1001", home: "/home/alice"})
+
+	ctxA := WithHome(context.Background(), "/home/a")
+	ctxB := WithHome(context.Background(), "/home/b")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, tc := range []struct {
+		ctx  context.Context
+		home string
+	}{
+		{ctx: ctxA, home: "/home/a"},
+		{ctx: ctxB, home: "/home/b"},
+	} {
+		tc := tc
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				actual, err := ExpandContext(tc.ctx, "~/x")
+				if expected := filepath.Join(tc.home, "x"); err != nil || actual != expected {
+					errs <- fmt.Errorf("ExpandContext(%q) = %q, want %q (err: %v)", "~/x", actual, expected, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if actual, err := DirContext(ctxA); err != nil || actual != "/home/a" {
+		t.Errorf("DirContext() = %q, want %q (err: %v)", actual, "/home/a", err)
+	}
+	if home, ok := HomeFromContext(ctxB); !ok || home != "/home/b" {
+		t.Errorf("HomeFromContext() = %q, %v, want %q", home, ok, "/home/b")
+	}
+
+	// ~user paths are still resolved as usual
+	if actual, err := ExpandContext(ctxA, "~alice/x"); err != nil || actual != filepath.Join("/home/alice", "x") {
+		t.Errorf("ExpandContext(%q) = %q, want %q (err: %v)", "~alice/x", actual, filepath.Join("/home/alice", "x"), err)
+	}
+
+	// the context home is used everywhere a `~` is expanded, with the usual processing
+	SetExpandAfterEquals(true)
+	SetExpandPostProcessor(strings.ToUpper)
+	t.Cleanup(func() {
+		SetExpandAfterEquals(false)
+		SetExpandPostProcessor(nil)
+	})
+	ResetStats()
+	if actual, err := ExpandContext(ctxA, "K=~/x"); err != nil || actual != strings.ToUpper("K="+filepath.Join("/home/a", "x")) {
+		t.Errorf("ExpandContext(%q) = %q, want the processed context home (err: %v)", "K=~/x", actual, err)
+	}
+	if actual, err := ExpandContext(ctxA, "~/x"); err != nil || actual != strings.ToUpper(filepath.Join("/home/a", "x")) {
+		t.Errorf("ExpandContext(%q) = %q, want the processed context home (err: %v)", "~/x", actual, err)
+	}
+	if tilde, _, _ := ExpandCounters(); tilde != 2 {
+		t.Errorf("expected 2 tilde expansions to be counted, got %d", tilde)
+	}
+	SetExpandAfterEquals(false)
+	SetExpandPostProcessor(nil)
+
+	// without a home in the context, the global one applies
+	if actual, err := ExpandContext(context.Background(), "~/x"); err != nil || actual != filepath.Join("/home/global", "x") {
+		t.Errorf("ExpandContext(%q) = %q, want %q (err: %v)", "~/x", actual, filepath.Join("/home/global", "x"), err)
+	}
+	if _, ok := HomeFromContext(context.Background()); ok {
+		t.Error("expected no home in a plain context")
+	}
+}
+
+// recordingLogger records all logged messages
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...any) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestSetUnknownUserPolicy(t *testing.T) {
+	restoreCache(t)
+	stubLookupUser(t)
+
+	tests := []struct {
+		name   string
+		policy UnknownUserPolicy
+		output string
+		err    bool
+		warned bool
+	}{
+		{
+			name:   "error",
+			policy: UnknownUserError,
+			err:    true,
+		},
+		{
+			name:   "passthrough",
+			policy: UnknownUserPassthrough,
+			output: "~mallory/x",
+		},
+		{
+			name:   "passthrough with warning",
+			policy: UnknownUserPassthroughWithWarn,
+			output: "~mallory/x",
+			warned: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			log := &recordingLogger{}
+			SetLogger(log)
+			SetUnknownUserPolicy(tc.policy)
+
+			actual, err := Expand("~mallory/x")
+			if (err != nil) != tc.err {
+				t.Fatalf("Expand() error: got %v, want error: %v", err, tc.err)
+			}
+			if actual != tc.output {
+				t.Errorf("expected %q, got %q", tc.output, actual)
+			}
+
+			if tc.warned != (len(log.messages) > 0) {
+				t.Errorf("expected warning: %v, got messages: %q", tc.warned, log.messages)
+			}
+			if tc.warned && !strings.Contains(log.messages[0], "~mallory/x") {
+				t.Errorf("expected warning to mention the path, got: %q", log.messages[0])
+			}
+		})
+	}
+
+	// failures other than an unknown user are not subject to the policy
+	SetUnknownUserPolicy(UnknownUserPassthrough)
+	if _, err := Expand("~bad:user/x"); !errors.Is(err, ErrBadTilde) {
+		t.Errorf("expected ErrBadTilde, got %v", err)
+	}
+	lookupUser = func(key string) (passwdEntry, error) {
+		return passwdEntry{}, errors.New("directory service unavailable")
+	}
+	if actual, err := Expand("~mallory/x"); err == nil {
+		t.Errorf("expected a failing lookup to be reported, got %q", actual)
+	}
+}
+
+func TestSetPasswdPath(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" || runtime.GOOS == "darwin" {
+		t.Skipf("the passwd file is not consulted on %s", runtime.GOOS)
+	}
+	restoreCache(t)
+
+	uid := strconv.Itoa(os.Getuid())
+	fixture := filepath.Join(t.TempDir(), "passwd")
+	contents := strings.Join([]string{
+		"# a comment:x:" + uid + ":0::/commented:/bin/sh",
+		"",
+		"other:x:4242:4242::/home/other:/bin/sh",
+		"fixture:x:" + uid + ":0:Fixture User:/home/fixture:/bin/sh",
+		"nohome:x:4343:4343:::/bin/sh",
+	}, "\n")
+	if err := os.WriteFile(fixture, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write fixture: %s", err)
+	}
+	SetPasswdPath(fixture)
+
+	// make getent unavailable so the passwd file is used
+	patchEnv(t, "PATH", t.TempDir())
+
+	home, err := getentHome()
+	if err != nil {
+		t.Fatalf("getentHome() failed: %s", err)
+	}
+	if home != "/home/fixture" {
+		t.Errorf("expected %q, got %q", "/home/fixture", home)
+	}
+
+	tests := []struct {
+		name        string
+		key         string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "by uid",
+			key:      uid,
+			expected: "/home/fixture",
+		},
+		{
+			name:     "by name",
+			key:      "other",
+			expected: "/home/other",
+		},
+		{
+			name:        "unknown user",
+			key:         "mallory",
+			expectError: true,
+		},
+		{
+			name:        "user without home",
+			key:         "nohome",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := HomeDirOf(tc.key)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("HomeDirOf(%q) error: got %v, want error: %v", tc.key, err, tc.expectError)
+			}
+			if dir != tc.expected {
+				t.Errorf("HomeDirOf(%q) = %q, want %q", tc.key, dir, tc.expected)
+			}
+		})
+	}
+
+	// an empty path restores the default
+	SetPasswdPath("")
+	if actual := passwdPath.Load().(string); actual != defaultPasswdPath {
+		t.Errorf("expected %q, got %q", defaultPasswdPath, actual)
+	}
+}
+
+func TestDirForCurrentUser(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skipf("looking up users is not supported on %s", runtime.GOOS)
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatalf("failed to get current user: %s", err)
+	}
+
+	dir, err := DirForUID(os.Getuid())
+	if err != nil {
+		t.Fatalf("DirForUID() failed: %s", err)
+	}
+	if dir != u.HomeDir {
+		t.Errorf("expected home dir %q, got %q", u.HomeDir, dir)
+	}
+
+	dir, err = DirFor(u.Username)
+	if err != nil {
+		t.Fatalf("DirFor() failed: %s", err)
+	}
+	if dir != u.HomeDir {
+		t.Errorf("expected home dir %q, got %q", u.HomeDir, dir)
+	}
+}
+
+func TestSetRespectSSHUser(t *testing.T) {
+	t.Cleanup(func() {
+		SetRespectSSHUser(false)
+	})
+
+	stubLookupUser(t,
+		passwdEntry{name: "svc", uid: strconv.Itoa(os.Getuid()), home: "/home/svc"},
+		passwdEntry{name: "alice", uid: "1000", home: "/home/alice"},
+	)
+
+	tests := []struct {
+		name     string
+		enable   bool
+		env      map[string]string
+		expected string
+	}{
+		{
+			name:     "disabled",
+			enable:   false,
+			env:      map[string]string{"SSH_USER": "alice", "LOGNAME": ""},
+			expected: "",
+		},
+		{
+			name:     "ssh user differs from process user",
+			enable:   true,
+			env:      map[string]string{"SSH_USER": "alice", "LOGNAME": ""},
+			expected: "/home/alice",
+		},
+		{
+			name:     "logname differs from process user",
+			enable:   true,
+			env:      map[string]string{"SSH_USER": "", "LOGNAME": "alice"},
+			expected: "/home/alice",
+		},
+		{
+			name:     "ssh user matches process user",
+			enable:   true,
+			env:      map[string]string{"SSH_USER": "svc", "LOGNAME": ""},
+			expected: "",
+		},
+		{
+			name:     "unknown ssh user",
+			enable:   true,
+			env:      map[string]string{"SSH_USER": "mallory", "LOGNAME": ""},
+			expected: "",
+		},
+		{
+			name:     "no user env vars",
+			enable:   true,
+			env:      map[string]string{"SSH_USER": "", "LOGNAME": ""},
+			expected: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetRespectSSHUser(tc.enable)
+			for k, v := range tc.env {
+				patchEnv(t, k, v)
+			}
+
+			dir, src, err := Detect()
+			if err != nil {
+				t.Fatalf("Detect() failed: %s", err)
+			}
+
+			if tc.expected == "" {
+				// falls back to the usual detection
+				if src == SourceSSHUser {
+					t.Errorf("expected fallback detection, got %q from %v", dir, src)
+				}
+				return
+			}
+
+			if dir != tc.expected || src != SourceSSHUser {
+				t.Errorf("expected %q from %v, got %q from %v", tc.expected, SourceSSHUser, dir, src)
+			}
+		})
+	}
+}
+
+// fakeBin writes the given shell scripts into a temporary directory and makes it the only entry in $PATH;
+// links names real tools from the original $PATH into it
+func fakeBin(t *testing.T, scripts map[string]string, links ...string) {
+	t.Helper()
+	bin := t.TempDir()
+	for _, name := range links {
+		target, err := exec.LookPath(name)
+		if err != nil {
+			t.Skipf("%s is not available: %s", name, err)
+		}
+		if err := os.Symlink(target, filepath.Join(bin, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+			t.Fatalf("failed to write fake %s: %s", name, err)
+		}
+	}
+	patchEnv(t, "PATH", bin)
+}
+
+func TestGetentLookup(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skipf("getent is not used on %s", runtime.GOOS)
+	}
+
+	// answers with an entry for the requested key, and with root for anything that looks like an option
+	fakeBin(t, map[string]string{"getent": `case "$2" in
+-*) echo 'root:x:0:0::/root:/bin/sh' ;;
+alice|1000) echo 'alice:x:1000:1000::/home/alice:/bin/sh' ;;
+mallory) echo 'root:x:0:0::/root:/bin/sh' ;;
+*) exit 2 ;;
+esac
+`}, "sh")
+
+	for _, key := range []string{"alice", "1000"} {
+		entry, err := getentLookup(key)
+		if err != nil {
+			t.Fatalf("getentLookup(%q) failed: %s", key, err)
+		}
+		expected := passwdEntry{name: "alice", uid: "1000", home: "/home/alice"}
+		if entry != expected {
+			t.Errorf("getentLookup(%q): expected %+v, got %+v", key, expected, entry)
+		}
+	}
+
+	for _, key := range []string{"", "-s", "--service=files", "nosuch"} {
+		if entry, err := getentLookup(key); !errors.Is(err, ErrUnknownUser) {
+			t.Errorf("getentLookup(%q): expected ErrUnknownUser, got %+v (err: %v)", key, entry, err)
+		}
+	}
+
+	if entry, err := getentLookup("mallory"); err == nil {
+		t.Errorf("expected an entry for another user to be rejected, got %+v", entry)
+	}
+}
+
+func TestDsclLookup(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skipf("the lookup script needs a POSIX shell, not available on %s", runtime.GOOS)
+	}
+
+	// options must be separated from the key, and only alice exists
+	fakeBin(t, map[string]string{
+		"id": `[ "$2" = "--" ] || exit 64
+[ "$3" = "alice" ] || [ "$3" = "501" ] || exit 1
+case "$1" in
+-nu) echo alice ;;
+-u) echo 501 ;;
+esac
+`,
+		"dscl": `[ "$4" = "/Users/alice" ] || exit 1
+echo 'NFSHomeDirectory: /Users/alice'
+`,
+	}, "sh", "sed")
+
+	for _, key := range []string{"alice", "501"} {
+		entry, err := dsclLookup(key)
+		if err != nil {
+			t.Fatalf("dsclLookup(%q) failed: %s", key, err)
+		}
+		expected := passwdEntry{name: "alice", uid: "501", home: "/Users/alice"}
+		if entry != expected {
+			t.Errorf("dsclLookup(%q): expected %+v, got %+v", key, expected, entry)
+		}
+	}
+
+	for _, key := range []string{"", "-s", "--help", "nosuch"} {
+		if entry, err := dsclLookup(key); !errors.Is(err, ErrUnknownUser) {
+			t.Errorf("dsclLookup(%q): expected ErrUnknownUser, got %+v (err: %v)", key, entry, err)
+		}
+	}
+}
+
+func TestExpandOptionLikeUser(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skipf("looking up users is not supported on %s", runtime.GOOS)
+	}
+	restoreCache(t)
+	SetExpandUserLookup(true)
+	t.Cleanup(func() {
+		SetExpandUserLookup(false)
+	})
+
+	for _, path := range []string{"~--service=files/x", "~-s/x"} {
+		if result, err := Expand(path); err == nil {
+			t.Errorf("Expand(%q): expected an error, got %q", path, result)
+		}
+	}
+	if dir, err := HomeDirOf("-s"); err == nil {
+		t.Errorf("HomeDirOf(%q): expected an error, got %q", "-s", dir)
+	}
+}